@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/mjmorales/doan/pkg/agent"
+)
+
+// lockWorkingDir takes the working directory lock for a command. The returned
+// function records the command as the manual trigger of its syncs and applies
+// and releases the lock, it is nil if the lock cannot be taken.
+func lockWorkingDir(agentConfig *agent.AgentConfig) (func(), int) {
+	lockTimeout, _ := time.ParseDuration(agentConfig.LockTimeout)
+	lock, err := agent.AcquireLock(agentConfig.DataDir, lockTimeout)
+	if errors.Is(err, agent.ErrLocked) {
+		log.Error().Err(err).Msg("another doan process is syncing or applying, set -lock-timeout to wait for it")
+		return nil, ExitLocked
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to lock working directory")
+		return nil, ExitFailure
+	}
+
+	startedAt := time.Now()
+	return func() {
+		err := agent.RecordTriggers(agentConfig.DataDir, startedAt, []agent.Trigger{agent.TriggerManual})
+		if err != nil {
+			log.Error().Err(err).Msg("failed to record triggers")
+		}
+
+		err = lock.Release()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to release working directory lock")
+		}
+	}, ExitOK
+}
+
+// initCommand creates the working directories, syncs and applies
+func initCommand(args []string) int {
+	fs, configFilePathPtr := newCommandFlagSet("init", "Create the working directories, download the latest ansible repo and run the playbook.")
+	agentConfig, exitCode := parseCommand(fs, configFilePathPtr, args)
+	if agentConfig == nil {
+		return exitCode
+	}
+
+	unlock, exitCode := lockWorkingDir(agentConfig)
+	if unlock == nil {
+		return exitCode
+	}
+
+	defer unlock()
+
+	log.Info().Msg("initializing agent")
+	err := agent.Init(*agentConfig)
+	if errors.Is(err, agent.ErrApplyDeferred) {
+		log.Warn().Err(err).Msg("initialized agent without applying")
+		return ExitDeferred
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to initialize agent")
+		return ExitFailure
+	}
+
+	return ExitOK
+}
+
+// syncCommand downloads and activates the latest ansible repo
+func syncCommand(args []string) int {
+	fs, configFilePathPtr := newCommandFlagSet("sync", "Download the latest ansible repo if it changed and make it the active release.")
+	agentConfig, exitCode := parseCommand(fs, configFilePathPtr, args)
+	if agentConfig == nil {
+		return exitCode
+	}
+
+	unlock, exitCode := lockWorkingDir(agentConfig)
+	if unlock == nil {
+		return exitCode
+	}
+
+	defer unlock()
+
+	err := agent.DeployRepo(*agentConfig)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to update ansible repo")
+		return ExitFailure
+	}
+
+	return ExitOK
+}
+
+// applyCommand runs the playbook of the active release,
+// or checks a staged release in dry run mode
+func applyCommand(args []string) int {
+	fs, configFilePathPtr := newCommandFlagSet("apply", "Run the playbook of the active release. With -dry-run the playbook runs with --check --diff and reports the tasks that would change.")
+	releasePtr := fs.String("release", "", "staged release to check instead of the active release, requires -dry-run")
+	emergencyPtr := fs.Bool("emergency", false, "apply outside the maintenance windows of the host")
+	agentConfig, exitCode := parseCommand(fs, configFilePathPtr, args)
+	if agentConfig == nil {
+		return exitCode
+	}
+
+	unlock, exitCode := lockWorkingDir(agentConfig)
+	if unlock == nil {
+		return exitCode
+	}
+
+	defer unlock()
+
+	opts := agent.PlaybookOptions{
+		Check:                    agentConfig.DryRun,
+		IgnoreMaintenanceWindows: *emergencyPtr,
+	}
+
+	if *emergencyPtr && !opts.Check {
+		log.Warn().Msg("emergency apply, ignoring the maintenance windows")
+	}
+
+	if *releasePtr != "" {
+		if !agentConfig.DryRun {
+			fmt.Fprintln(fs.Output(), "-release requires -dry-run, only the active release can be applied")
+			return ExitUsage
+		}
+
+		releasePath, err := agent.ReleasePath(agentConfig.DataDir, *releasePtr)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to find release")
+			return ExitFailure
+		}
+
+		opts.ReleasePath = releasePath
+	}
+
+	_, err := agent.RunAnsiblePlaybook(*agentConfig, opts)
+	if errors.Is(err, agent.ErrApplyDeferred) {
+		log.Warn().Err(err).Msg("outside the maintenance windows, use -emergency to apply now")
+		return ExitDeferred
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to run ansible")
+		return ExitFailure
+	}
+
+	return ExitOK
+}
+
+// runCommand syncs and applies once
+func runCommand(args []string) int {
+	fs, configFilePathPtr := newCommandFlagSet("run", "Download the latest ansible repo and run the playbook of the active release once.")
+	agentConfig, exitCode := parseCommand(fs, configFilePathPtr, args)
+	if agentConfig == nil {
+		return exitCode
+	}
+
+	unlock, exitCode := lockWorkingDir(agentConfig)
+	if unlock == nil {
+		return exitCode
+	}
+
+	defer unlock()
+
+	exitCode = ExitOK
+	err := agent.DeployRepo(*agentConfig)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to update ansible repo")
+		exitCode = ExitFailure
+	}
+
+	// the active release is applied even if the sync failed
+	err = agent.RunActiveAnsiblePlaybook(*agentConfig)
+	if errors.Is(err, agent.ErrApplyDeferred) {
+		log.Warn().Err(err).Msg("outside the maintenance windows")
+		if exitCode == ExitOK {
+			exitCode = ExitDeferred
+		}
+	} else if err != nil {
+		log.Error().Err(err).Msg("failed to run ansible")
+		exitCode = ExitFailure
+	}
+
+	return exitCode
+}
+
+// daemonCommand syncs and applies on their schedules until stopped
+func daemonCommand(args []string) int {
+	fs, configFilePathPtr := newCommandFlagSet("daemon", "Download the latest ansible repo on the sync interval and run the playbook on the daemon schedule until stopped.")
+	agentConfig, exitCode := parseCommand(fs, configFilePathPtr, args)
+	if agentConfig == nil {
+		return exitCode
+	}
+
+	log.Info().Msg("starting agent in daemon mode")
+	err := agent.Daemon(*agentConfig)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to start daemon")
+		return ExitFailure
+	}
+
+	return ExitOK
+}
+
+// statusOutput is the JSON output of the status command
+type statusOutput struct {
+	ActiveRelease string               `json:"active_release"`
+	Releases      int                  `json:"releases"`
+	LastSync      *agent.RunRecord     `json:"last_sync,omitempty"`
+	LastApply     *agent.RunRecord     `json:"last_apply,omitempty"`
+	LastCheck     *agent.RunRecord     `json:"last_check,omitempty"`
+	Drift         *agent.DriftRecord   `json:"drift,omitempty"`
+	Lock          *agent.LockOwner     `json:"lock,omitempty"`
+	Circuit       *agent.CircuitRecord `json:"artifactory_circuit,omitempty"`
+}
+
+// formatRunRecord returns a one line summary of a sync or apply
+func formatRunRecord(record *agent.RunRecord) string {
+	if record == nil {
+		return "never"
+	}
+
+	outcome := "succeeded"
+	if record.TimedOut {
+		outcome = "timed out: " + record.Error
+	} else if !record.Succeeded() {
+		outcome = "failed: " + record.Error
+	}
+
+	summary := fmt.Sprintf("%s at %s (took %s)", outcome, record.FinishedAt.Format(time.RFC3339), record.FinishedAt.Sub(record.StartedAt).Round(time.Second))
+	if len(record.Triggers) > 0 {
+		triggers := make([]string, 0, len(record.Triggers))
+		for _, trigger := range record.Triggers {
+			triggers = append(triggers, string(trigger))
+		}
+
+		summary += ", triggered by " + strings.Join(triggers, ", ")
+	}
+
+	if result := record.Result; result != nil {
+		summary += fmt.Sprintf(", ok=%d changed=%d failed=%d unreachable=%d skipped=%d", result.Ok, result.Changed, result.Failed, result.Unreachable, result.Skipped)
+	}
+
+	return summary
+}
+
+// formatDriftRecord returns a one line summary of the last drift check
+func formatDriftRecord(drift *agent.DriftRecord) string {
+	if drift == nil {
+		return "never checked"
+	}
+
+	checkedAt := drift.CheckedAt.Format(time.RFC3339)
+	// records written before check_failed only have the error
+	if drift.CheckFailed || drift.Error != "" {
+		return fmt.Sprintf("unknown, check failed at %s: %s", checkedAt, drift.Error)
+	}
+
+	if !drift.Drifted() {
+		return fmt.Sprintf("none at %s", checkedAt)
+	}
+
+	return fmt.Sprintf("%d tasks at %s: %s", len(drift.ChangedTasks), checkedAt, strings.Join(drift.ChangedTasks, ", "))
+}
+
+// formatLockOwner returns a one line summary of the working directory lock
+func formatLockOwner(owner *agent.LockOwner) string {
+	if owner == nil {
+		return "free"
+	}
+
+	if owner.PID == 0 {
+		return "held"
+	}
+
+	return fmt.Sprintf("held by %s (%s)", owner, strings.Join(owner.Command, " "))
+}
+
+// formatCircuitRecord returns a one line summary of the artifactory circuit breaker
+func formatCircuitRecord(circuit *agent.CircuitRecord) string {
+	if circuit == nil {
+		return "ok"
+	}
+
+	return circuit.String()
+}
+
+// statusCommand prints the active release and the outcome of the last sync and apply
+func statusCommand(args []string) int {
+	fs, configFilePathPtr := newCommandFlagSet("status", "Print the active release, the outcome of the last sync, apply and check and the drift.")
+	jsonPtr := fs.Bool("json", false, "print the status as JSON")
+	agentConfig, exitCode := parseCommand(fs, configFilePathPtr, args)
+	if agentConfig == nil {
+		return exitCode
+	}
+
+	activeRelease, err := agent.ActiveRelease(agentConfig.DataDir)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get active release")
+		return ExitFailure
+	}
+
+	releases, err := agent.ListReleases(agentConfig.DataDir)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list releases")
+		return ExitFailure
+	}
+
+	state, err := agent.ReadState(agentConfig.DataDir)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read agent state")
+		return ExitFailure
+	}
+
+	lockOwner, err := agent.ReadLockOwner(agentConfig.DataDir)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read working directory lock")
+		return ExitFailure
+	}
+
+	status := statusOutput{
+		ActiveRelease: activeRelease,
+		Releases:      len(releases),
+		LastSync:      state.LastSync,
+		LastApply:     state.LastApply,
+		LastCheck:     state.LastCheck,
+		Drift:         state.Drift,
+		Lock:          lockOwner,
+		Circuit:       state.Circuit,
+	}
+
+	if *jsonPtr {
+		return printJSON(status)
+	}
+
+	if status.ActiveRelease == "" {
+		status.ActiveRelease = "none"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "active release:\t%s\n", status.ActiveRelease)
+	fmt.Fprintf(w, "releases:\t%d\n", status.Releases)
+	fmt.Fprintf(w, "last sync:\t%s\n", formatRunRecord(status.LastSync))
+	fmt.Fprintf(w, "last apply:\t%s\n", formatRunRecord(status.LastApply))
+	fmt.Fprintf(w, "last check:\t%s\n", formatRunRecord(status.LastCheck))
+	fmt.Fprintf(w, "drift:\t%s\n", formatDriftRecord(status.Drift))
+	fmt.Fprintf(w, "lock:\t%s\n", formatLockOwner(status.Lock))
+	fmt.Fprintf(w, "artifactory:\t%s\n", formatCircuitRecord(status.Circuit))
+	w.Flush()
+	return ExitOK
+}
+
+// releasesCommand lists the staged releases
+func releasesCommand(args []string) int {
+	fs, configFilePathPtr := newCommandFlagSet("releases", "List the staged releases from oldest to newest, the active release is marked with a *.")
+	jsonPtr := fs.Bool("json", false, "print the releases as JSON")
+	agentConfig, exitCode := parseCommand(fs, configFilePathPtr, args)
+	if agentConfig == nil {
+		return exitCode
+	}
+
+	releases, err := agent.ListReleases(agentConfig.DataDir)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list releases")
+		return ExitFailure
+	}
+
+	if *jsonPtr {
+		return printJSON(releases)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tRELEASE\tCREATED\tPATH")
+	for _, release := range releases {
+		marker := ""
+		if release.Active {
+			marker = "*"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", marker, release.ID, release.CreatedAt.Format(time.RFC3339), release.Path)
+	}
+
+	w.Flush()
+	return ExitOK
+}
+
+// rollbackCommand activates an older staged release again
+func rollbackCommand(args []string) int {
+	fs, configFilePathPtr := newCommandFlagSet("rollback", "Activate the release staged before the active release, or the release given with -release. It stays active until a new tarball is deployed.")
+	releasePtr := fs.String("release", "", "staged release to activate instead of the one before the active release")
+	agentConfig, exitCode := parseCommand(fs, configFilePathPtr, args)
+	if agentConfig == nil {
+		return exitCode
+	}
+
+	unlock, exitCode := lockWorkingDir(agentConfig)
+	if unlock == nil {
+		return exitCode
+	}
+
+	defer unlock()
+
+	release, err := agent.Rollback(*agentConfig, *releasePtr)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to roll back")
+		return ExitFailure
+	}
+
+	log.Info().Msgf("rolled back to release %s, run doan apply to apply it", release)
+	return ExitOK
+}
+
+// versionCommand prints the version
+func versionCommand(args []string) int {
+	fmt.Println(agent.GetVersion())
+	return ExitOK
+}
+
+// printJSON prints v as indented JSON
+func printJSON(v interface{}) int {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Error().Err(err).Msg("failed to marshal output")
+		return ExitFailure
+	}
+
+	fmt.Println(string(content))
+	return ExitOK
+}
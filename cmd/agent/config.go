@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/mjmorales/doan/pkg/agent"
+)
+
+const configUsage = `usage: doan config <command> [flags]
+
+commands:
+  show      print the merged config, --effective adds where each value came from
+  validate  check the merged config, or each config file given as an argument
+`
+
+// configCommand runs the config subcommands and returns the exit code
+func configCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, configUsage)
+		return ExitUsage
+	}
+
+	switch args[0] {
+	case "show":
+		return configShowCommand(args[1:])
+	case "validate":
+		return configValidateCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown config command %q\n\n%s", args[0], configUsage)
+		return ExitUsage
+	}
+}
+
+// configShowCommand prints the merged config
+func configShowCommand(args []string) int {
+	fs := flag.NewFlagSet("config show", flag.ContinueOnError)
+	configFilePathPtr := fs.String("config-file-path", "", "path to the config file")
+	effectivePtr := fs.Bool("effective", false, "print where each value came from")
+	registerConfigFlags(fs)
+
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return ExitOK
+	}
+
+	if err != nil {
+		return ExitUsage
+	}
+
+	agentConfig, sources, err := agent.LoadAgentConfig(*configFilePathPtr, configOverrides(fs))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load agent config: %s\n", err)
+		return ExitConfig
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, key := range agent.ConfigKeys() {
+		value := formatConfigValue(agentConfig, key)
+		if *effectivePtr {
+			fmt.Fprintf(w, "%s: %s\t# %s\n", key, value, sources[key])
+		} else {
+			fmt.Fprintf(w, "%s: %s\n", key, value)
+		}
+	}
+
+	w.Flush()
+	return ExitOK
+}
+
+// configValidateCommand validates the merged config, or each config file
+// given as an argument layered with the environment and flags.
+// It returns ExitConfig if any config is invalid.
+func configValidateCommand(args []string) int {
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	configFilePathPtr := fs.String("config-file-path", "", "path to the config file")
+	registerConfigFlags(fs)
+
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return ExitOK
+	}
+
+	if err != nil {
+		return ExitUsage
+	}
+
+	configFiles := fs.Args()
+	if len(configFiles) == 0 {
+		configFiles = []string{*configFilePathPtr}
+	}
+
+	exitCode := ExitOK
+	for _, configFile := range configFiles {
+		name := configFile
+		if name == "" {
+			name = "config"
+		}
+
+		_, _, err := agent.LoadAgentConfig(configFile, configOverrides(fs))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s is invalid:\n%s\n", name, err)
+			exitCode = ExitConfig
+			continue
+		}
+
+		fmt.Printf("%s is valid\n", name)
+	}
+
+	return exitCode
+}
+
+// formatConfigValue returns the YAML value of a config key with secrets redacted
+func formatConfigValue(agentConfig *agent.AgentConfig, key string) string {
+	value := agentConfig.Value(key)
+	if agent.IsSecretConfigKey(key) && value != "" {
+		return "<redacted>"
+	}
+
+	content, err := yaml.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+
+	return strings.TrimSpace(string(content))
+}
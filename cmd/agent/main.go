@@ -11,91 +11,210 @@ import (
 	logger "github.com/mjmorales/doan/pkg/logger"
 )
 
-// ParseFlags parses the command line flags
-func ParseFlags() agent.CLIFlags {
-	updateAnsibleRepoPtr := flag.Bool("update-ansible-repo", false, "update the ansible repo and Exit (default: false)")
-	jfrogCLIConfigPathPtr := flag.String("jfrog-cli-config-path", "$HOME/.jfrog/jfrog-cli.conf", "path to the JFrog CLI config file (default: $HOME/.jfrog/jfrog-cli.conf)")
-	ansibleRepoPath := flag.String("ansible-repo-path", "generic-repo/path/to/tar", "path to the ansible repo (default: generic-repo/path/to/tar)")
-	initPtr := flag.Bool("init", false, "initialize the agent (default: false)")
-	maxStagingReposPtr := flag.Int("max-staging-repos", 10, "maximum number of staging repos to keep (default: 10)")
-	ansibleTarballNamePtr := flag.String("ansible-tarball-name", "ansible.tar.gz", "name of the ansible tarball (default: ansible.tar.gz)")
-	ansibleNameSpacePtr := flag.String("ansible-namespace", "ansible", "name of the ansible namespace (default: ansible)")
-	daemonPtr := flag.Bool("daemon", false, "run binary in daemon mode (default: false)")
-	daemonIntervalPtr := flag.String("daemon-interval", "1m", "interval string to run the daemon (default: 1m)")
-	configFilePathPtr := flag.String("config-file-path", "", "path to the config file (default: \"\")")
-	versionPtr := flag.Bool("version", false, "print the version and exit (default: false)")
-	logFilePtr := flag.String("logfile", "", "path to the log file (default: \"\")")
-
-	flag.Parse()
-	agentFlags := agent.CLIFlags{
-		UpdateAnsibleRepo:  *updateAnsibleRepoPtr,
-		JFrogCLIConfigPath: *jfrogCLIConfigPathPtr,
-		AnsibleRepoPath:    *ansibleRepoPath,
-		Init:               *initPtr,
-		MaxStagingRepos:    *maxStagingReposPtr,
-		AnsibleTarballName: *ansibleTarballNamePtr,
-		AnsibleNameSpace:   *ansibleNameSpacePtr,
-		Daemon:             *daemonPtr,
-		DaemonInterval:     *daemonIntervalPtr,
-		ConfigFilePath:     *configFilePathPtr,
-		Version:            *versionPtr,
-		LogFile:            *logFilePtr,
+// Exit codes returned by the doan commands
+const (
+	// ExitOK is returned when the command succeeded
+	ExitOK = 0
+	// ExitFailure is returned when a sync, apply or other operation failed
+	ExitFailure = 1
+	// ExitUsage is returned for unknown commands and invalid flags
+	ExitUsage = 2
+	// ExitConfig is returned when the agent config cannot be loaded or is invalid
+	ExitConfig = 3
+	// ExitDeferred is returned when an apply is deferred
+	// because it is outside the maintenance windows
+	ExitDeferred = 4
+	// ExitLocked is returned when another doan process holds the working directory lock
+	ExitLocked = 5
+)
+
+const usage = `usage: doan <command> [flags]
+
+commands:
+  init      create the working directories, sync and apply
+  sync      download and activate the latest ansible repo
+  apply     run the playbook of the active release
+  run       sync and apply once
+  daemon    sync and apply on their schedules
+  status    print the active release and the outcome of the last sync, apply and check
+  releases  list the staged releases
+  rollback  activate an older staged release again
+  config    show or validate the agent config
+  manifest  write the file manifest and objects of a tarball for delta updates
+  version   print the version
+
+Run 'doan <command> -h' for the flags of a command.
+
+exit codes:
+  0  success
+  1  the operation failed
+  2  unknown command or invalid flags
+  3  the agent config cannot be loaded or is invalid
+  4  the apply was deferred outside the maintenance windows
+  5  another doan process is syncing or applying
+`
+
+// command is a doan subcommand returning its exit code
+type command func(args []string) int
+
+var commands = map[string]command{
+	"init":     initCommand,
+	"sync":     syncCommand,
+	"apply":    applyCommand,
+	"run":      runCommand,
+	"daemon":   daemonCommand,
+	"status":   statusCommand,
+	"releases": releasesCommand,
+	"rollback": rollbackCommand,
+	"config":   configCommand,
+	"manifest": manifestCommand,
+	"version":  versionCommand,
+}
+
+// registerConfigFlags registers a flag for each config key.
+// Only the flags set on the command line override the other config layers.
+func registerConfigFlags(fs *flag.FlagSet) {
+	defaults := agent.DefaultAgentConfig()
+	fs.String("jfrog-cli-config-path", defaults.JFrogCLIConfigPath, "path to the JFrog CLI config file")
+	fs.String("jfrog-server-id", defaults.JFrogServerID, "server id in the JFrog CLI config, the default server is used when empty")
+	fs.String("artifactory-url", defaults.ArtifactoryURL, "artifactory url, takes precedence over the JFrog CLI config when set")
+	fs.String("artifactory-user", defaults.ArtifactoryUser, "artifactory user")
+	fs.String("artifactory-credentials-file", defaults.ArtifactoryCredentialsFile, "path to a file holding the artifactory url, user and token")
+	fs.String("data-dir", defaults.DataDir, "working directory holding the releases and agent state")
+	fs.String("ansible-repo-path", defaults.AnsibleRepoPath, "path to the ansible repo")
+	fs.Int("max-staging-repos", defaults.MaxStagingRepos, "maximum number of staging repos to keep")
+	fs.String("ansible-tarball-name", defaults.AnsibleTarballName, "deprecated and ignored, tarballs are cached by their digest")
+	fs.String("ansible-namespace", defaults.AnsibleNameSpace, "deprecated and ignored, tarballs are cached by their digest")
+	fs.Int("retry-attempts", defaults.RetryAttempts, "number of times a call to artifactory or the metadata API is tried")
+	fs.String("retry-base-delay", defaults.RetryBaseDelay, "delay before the first retry, doubled on every retry")
+	fs.String("retry-max-delay", defaults.RetryMaxDelay, "maximum delay between retries")
+	fs.String("remote-timeout", defaults.RemoteTimeout, "timeout of a single call to artifactory or the metadata API")
+	fs.String("download-timeout", defaults.DownloadTimeout, "timeout of a single tarball download")
+	fs.Bool("stream-extract", defaults.StreamExtract, "extract tarballs while downloading them instead of caching them on disk first")
+	fs.Bool("delta-updates", defaults.DeltaUpdates, "download only the files that changed when a file manifest is published next to the tarball")
+	fs.Bool("dedupe-releases", defaults.DedupeReleases, "hardlink the identical files of the staged releases to one shared copy")
+	fs.String("galaxy-timeout", defaults.GalaxyTimeout, "time after which installing the galaxy requirements of a release is stopped and fails")
+	fs.String("rollout-identity", defaults.RolloutIdentity, "what the rollout bucket and splay of the host are derived from: auto, droplet_id or hostname")
+	fs.Int("circuit-breaker-threshold", defaults.CircuitBreakerThreshold, "failed artifactory calls in a row after which artifactory is not called during the cooldown, 0 disables the breaker")
+	fs.String("circuit-breaker-cooldown", defaults.CircuitBreakerCooldown, "time artifactory is not called after the circuit breaker opened")
+	fs.String("daemon-interval", defaults.DaemonInterval, "interval string to apply in daemon mode")
+	fs.String("sync-interval", defaults.SyncInterval, "interval string to sync in daemon mode")
+	fs.Bool("apply-on-change", defaults.ApplyOnChange, "apply as soon as a sync activates a new release in daemon mode")
+	fs.String("daemon-schedule", defaults.DaemonSchedule, "cron expression to apply on in daemon mode, takes precedence over the daemon interval")
+	fs.String("daemon-timezone", defaults.DaemonTimezone, "timezone of the daemon schedule")
+	fs.String("daemon-splay", defaults.DaemonSplay, "maximum fixed per host delay of scheduled runs")
+	fs.String("daemon-jitter", defaults.DaemonJitter, "maximum random delay added to every scheduled run")
+	fs.Bool("daemon-run-on-start", defaults.DaemonRunOnStart, "run once when the daemon starts")
+	fs.String("daemon-start-delay", defaults.DaemonStartDelay, "delay of the run on start")
+	fs.String("logfile", defaults.LogFile, "path to the log file")
+	fs.String("lease-artifact-path", defaults.LeaseArtifactPath, "artifactory path to the lock artifact holding the apply leases")
+	fs.Int("lease-slots", defaults.LeaseSlots, "number of hosts allowed to apply at the same time, 0 disables leases")
+	fs.String("lease-ttl", defaults.LeaseTTL, "time after which an apply lease expires")
+	fs.String("trigger-listen-address", defaults.TriggerListenAddress, "host:port to listen on for trigger webhook requests in daemon mode")
+	fs.String("drift-interval", defaults.DriftInterval, "interval string to check the active release for drift in daemon mode, disabled when empty")
+	fs.String("drift-metrics-file", defaults.DriftMetricsFile, "path to write the drift metrics to in the Prometheus text format")
+	fs.String("notify-events", defaults.NotifyEvents, "comma separated events to notify, all events when empty")
+	fs.String("notify-webhook-url", defaults.NotifyWebhookURL, "url to post event notifications to")
+	fs.String("notify-webhook-template", defaults.NotifyWebhookTemplate, "path to a Go template file rendering the webhook body, the event JSON is posted when empty")
+	fs.Bool("notify-syslog", defaults.NotifySyslog, "write event notifications to syslog")
+	fs.String("notify-command", defaults.NotifyCommand, "shell command to run with the event JSON on stdin")
+	fs.String("hook-pre-sync", defaults.HookPreSync, "shell command to run before a sync, a failure aborts the sync")
+	fs.String("hook-post-sync", defaults.HookPostSync, "shell command to run after a sync")
+	fs.String("hook-pre-activate", defaults.HookPreActivate, "shell command to run before a new release is activated, a failure aborts the activation")
+	fs.String("hook-pre-apply", defaults.HookPreApply, "shell command to run before an apply, a failure aborts the apply")
+	fs.String("hook-post-apply", defaults.HookPostApply, "shell command to run after an apply")
+	fs.String("hook-on-failure", defaults.HookOnFailure, "shell command to run when a sync or apply failed")
+	fs.String("hook-timeout", defaults.HookTimeout, "time after which a hook is killed and fails")
+	fs.String("lock-timeout", defaults.LockTimeout, "time to wait for another doan process to finish its sync or apply, fails right away when empty")
+	fs.String("run-timeout", defaults.RunTimeout, "time after which an ansible run is stopped and recorded as timed out, no timeout when empty")
+	fs.String("run-inactivity-timeout", defaults.RunInactivityTimeout, "time without ansible output after which a run is stopped and recorded as timed out, no timeout when empty")
+	fs.String("maintenance-windows", defaults.MaintenanceWindows, "semicolon separated windows outside of which applies are deferred, applies are allowed at any time when empty")
+	fs.String("maintenance-timezone", defaults.MaintenanceTimezone, "timezone of the maintenance windows")
+	fs.Bool("dry-run", defaults.DryRun, "run the playbook with --check --diff, reporting the tasks that would change without applying them")
+}
+
+// configOverrides returns the config keys explicitly set on the command line
+func configOverrides(fs *flag.FlagSet) map[string]string {
+	overrides := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		key := agent.ConfigKeyFromFlag(f.Name)
+		if agent.IsConfigKey(key) {
+			overrides[key] = f.Value.String()
+		}
+	})
+
+	return overrides
+}
+
+// newCommandFlagSet returns the flag set of a command with the config flags registered.
+// The returned string pointer holds the config file path.
+func newCommandFlagSet(name, description string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: doan %s [flags]\n\n%s\n\nflags:\n", name, description)
+		fs.PrintDefaults()
 	}
 
-	return agentFlags
+	configFilePathPtr := fs.String("config-file-path", "", "path to the config file")
+	registerConfigFlags(fs)
+	return fs, configFilePathPtr
 }
 
-func main() {
-	// parse the command line flags
-	agentFlags := ParseFlags()
-	agentConfig := &agent.AgentConfig{}
+// parseCommand parses the command flags, loads the agent config and sets up logging.
+// It returns a non-zero exit code if the command must not run.
+func parseCommand(fs *flag.FlagSet, configFilePathPtr *string, args []string) (*agent.AgentConfig, int) {
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return nil, ExitOK
+	}
 
-	if agentFlags.Version {
-		fmt.Print(agent.GetVersion())
-		os.Exit(0)
+	if err != nil {
+		return nil, ExitUsage
 	}
 
-	if agentFlags.ConfigFilePath != "" {
-		log.Info().Msg("loading agent config from file")
-		agentConfig = agentConfig.WithConfigFromFile(agentFlags.ConfigFilePath)
-	} else {
-		log.Info().Msg("loading agent config from CLI")
-		agentConfig = agentConfig.WithConfigFromCLI(agentFlags)
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected arguments: %v\n", fs.Args())
+		return nil, ExitUsage
 	}
 
 	logger.SetGlobalLogConfig()
+	agentConfig, _, err := agent.LoadAgentConfig(*configFilePathPtr, configOverrides(fs))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load agent config")
+		return nil, ExitConfig
+	}
+
 	if agentConfig.LogFile != "" {
-		f, err := logger.SetLogFile(*agentConfig)
+		_, err := logger.SetLogFile(*agentConfig)
 		if err != nil {
-			log.Fatal().Err(err).Msg("failed to set log file")
-			defer f.Close()
+			log.Error().Err(err).Msg("failed to set log file")
+			return nil, ExitConfig
 		}
 	}
 
-	// initialize the agent if the init flag is set
-	if agentFlags.Init {
-		log.Info().Msg("initializing agent")
-		err := agent.Init(*agentConfig)
-		if err != nil {
-			log.Fatal().Err(err).Msg("failed to initialize agent")
-		}
+	return agentConfig, ExitOK
+}
 
-		os.Exit(0)
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(ExitUsage)
 	}
 
-	// update the ansible repo if the update-ansible-repo flag is set
-	if agentFlags.UpdateAnsibleRepo {
-		err := agent.DeployRepo(*agentConfig)
-		if err != nil {
-			log.Fatal().Err(err).Msg("failed to update ansible repo")
-		}
-
-		os.Exit(0)
+	name := os.Args[1]
+	switch name {
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		os.Exit(ExitOK)
+	case "-version", "--version":
+		name = "version"
 	}
 
-	// start the agent if the agent flag is set
-	if agentConfig.Daemon {
-		log.Info().Msg("starting agent in daemon mode")
-		agent.Daemon(*agentConfig)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		os.Exit(ExitUsage)
 	}
+
+	os.Exit(cmd(os.Args[2:]))
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/mjmorales/doan/pkg/agent"
+	logger "github.com/mjmorales/doan/pkg/logger"
+)
+
+// manifestCommand writes the file manifest and the objects of a tarball
+// to be published next to it for delta updates
+func manifestCommand(args []string) int {
+	fs := flag.NewFlagSet("manifest", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: doan manifest [flags] <tarball>\n\nWrite the file manifest and the objects of a tarball, to be uploaded next to it for delta updates.\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+
+	outputPtr := fs.String("output", agent.FileManifestName, "path to write the file manifest to")
+	objectsDirPtr := fs.String("objects-dir", agent.ObjectsDirName, "directory to write the objects to, named by their sha256")
+
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return ExitOK
+	}
+
+	if err != nil {
+		return ExitUsage
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return ExitUsage
+	}
+
+	logger.SetGlobalLogConfig()
+	tarball := fs.Arg(0)
+	tmpDir, err := os.MkdirTemp("", "doan-manifest-")
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create temp directory")
+		return ExitFailure
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	bundleDir := filepath.Join(tmpDir, "bundle")
+	err = agent.Untar(tarball, bundleDir)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to untar tarball")
+		return ExitFailure
+	}
+
+	manifest, err := agent.ComputeFileManifest(bundleDir)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to compute file manifest")
+		return ExitFailure
+	}
+
+	manifest.Release, err = agent.HashFile(tarball)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to hash tarball")
+		return ExitFailure
+	}
+
+	err = agent.WriteObjects(bundleDir, manifest, *objectsDirPtr)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write objects")
+		return ExitFailure
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Error().Err(err).Msg("failed to marshal file manifest")
+		return ExitFailure
+	}
+
+	err = os.WriteFile(*outputPtr, append(content, '\n'), 0644)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write file manifest")
+		return ExitFailure
+	}
+
+	fmt.Printf("wrote %s with %d files and their objects to %s\n", *outputPtr, len(manifest.Files), *objectsDirPtr)
+	return ExitOK
+}
@@ -4,13 +4,11 @@ go 1.19
 
 require (
 	github.com/jfrog/jfrog-client-go v1.25.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/rs/zerolog v1.28.0
 )
 
-require (
-	github.com/robfig/cron/v3 v3.0.1 // indirect
-	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4 // indirect
-)
+require golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4 // indirect
 
 require (
 	github.com/CycloneDX/cyclonedx-go v0.7.0 // indirect
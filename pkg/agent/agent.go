@@ -1,66 +1,352 @@
 package agent
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os/exec"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/go-co-op/gocron"
 	"github.com/rs/zerolog/log"
 )
 
+// Job is a set of the jobs of a run
+type Job int
+
+const (
+	// JobSync downloads and activates the latest release
+	JobSync Job = 1 << iota
+	// JobApply applies the active release
+	JobApply
+	// JobCheck checks the active release for drift
+	JobCheck
+)
+
+// Trigger is what started a run
+type Trigger string
+
+const (
+	TriggerSchedule   Trigger = "schedule"
+	TriggerStart      Trigger = "start"
+	TriggerSignal     Trigger = "signal"
+	TriggerWebhook    Trigger = "webhook"
+	TriggerNewRelease Trigger = "new_release"
+	TriggerManual     Trigger = "manual"
+)
+
+// pendingRun is the run queued while the runner is busy,
+// merging the jobs and triggers of every request that arrived meanwhile
+type pendingRun struct {
+	jobs     Job
+	triggers []Trigger
+}
+
+// add merges jobs and a trigger into the pending run
+func (p *pendingRun) add(jobs Job, trigger Trigger) {
+	p.jobs |= jobs
+	for _, t := range p.triggers {
+		if t == trigger {
+			return
+		}
+	}
+
+	p.triggers = append(p.triggers, trigger)
+}
+
+// merge merges the jobs and triggers of other into the pending run
+func (p *pendingRun) merge(other *pendingRun) {
+	for _, trigger := range other.triggers {
+		p.add(other.jobs, trigger)
+	}
+}
+
 // Runner is a struct that holds a mutex lock
-// to prevent multiple ansible runs at the same time
+// to prevent multiple ansible runs at the same time.
+// Requests arriving while it runs are queued in a single pending run,
+// which runs once the current run is done.
+// Every run also takes the working directory lock,
+// so runs of other doan processes do not overlap either.
+// A run that cannot take the lock is queued again and retried
+// once the other process released it.
 type Runner struct {
-	mutex sync.Mutex
+	mutex   sync.Mutex
+	running bool
+	pending *pendingRun
 }
 
-// Run runs the DeployRepo and RunActiveAnsiblePlaybook functions
-// with a mutex lock to prevent multiple runs at the same time
-// Run returns early if the runner is already running
-func (r *Runner) Run(agentConfig AgentConfig) {
-	locked := r.mutex.TryLock()
-	if locked {
-		log.Error().Msg("this runner is already running")
+// Trigger runs jobs, or queues them into the pending run if the runner
+// is already running. The goroutine starting a run also runs the
+// pending run after it, so at most one follow-up run happens.
+func (r *Runner) Trigger(agentConfig AgentConfig, jobs Job, trigger Trigger) {
+	r.mutex.Lock()
+	if r.running {
+		if r.pending == nil {
+			r.pending = &pendingRun{}
+		}
+
+		r.pending.add(jobs, trigger)
+		log.Info().Str("trigger", string(trigger)).Msg("runner is busy, queued run")
+		r.mutex.Unlock()
 		return
 	}
 
+	r.running = true
+	r.mutex.Unlock()
+
+	run := &pendingRun{}
+	run.add(jobs, trigger)
+	for run != nil {
+		err := runLocked(agentConfig, func() {
+			runJobs(agentConfig, run)
+		})
+
+		if errors.Is(err, ErrLocked) {
+			log.Info().Msgf("%s, retrying the run once it is released", err)
+			r.requeue(run)
+			waitForUnlock(agentConfig.DataDir)
+		}
+
+		r.mutex.Lock()
+		run = r.pending
+		r.pending = nil
+		if run == nil {
+			r.running = false
+		}
+
+		r.mutex.Unlock()
+	}
+}
+
+// requeue puts run back in front of the pending run,
+// merging the requests that arrived meanwhile into it
+func (r *Runner) requeue(run *pendingRun) {
+	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	if r.pending != nil {
+		run.merge(r.pending)
+	}
+
+	r.pending = run
+}
+
+// waitForUnlock waits until no process holds the working directory lock
+func waitForUnlock(dataDir string) {
+	for {
+		owner, err := ReadLockOwner(dataDir)
+		if err != nil {
+			log.Error().Msgf("failed to read the lock owner: %s", err)
+			return
+		}
+
+		if owner == nil {
+			return
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// runLocked runs run with the working directory lock,
+// waiting up to the lock timeout for it. It returns ErrLocked
+// when another process still holds the lock after the timeout.
+func runLocked(agentConfig AgentConfig, run func()) error {
+	lock, err := AcquireLock(agentConfig.DataDir, parseOptionalDuration(agentConfig.LockTimeout))
+	if errors.Is(err, ErrLocked) {
+		return err
+	}
+
+	if err != nil {
+		log.Error().Msgf("failed to lock working directory: %s", err)
+		return err
+	}
+
+	defer func() {
+		err := lock.Release()
+		if err != nil {
+			log.Error().Msgf("failed to release working directory lock: %s", err)
+		}
+	}()
+
+	run()
+	return nil
+}
+
+// runJobs syncs, applies and checks for drift as requested by run
+// and records its triggers with the outcome of each job.
+// A sync activating a new release adds an apply when apply on change is configured.
+func runJobs(agentConfig AgentConfig, run *pendingRun) {
+	startedAt := time.Now()
+	log.Info().Msgf("run triggered by %s", formatTriggers(run.triggers))
+
+	var syncErr error
+	if run.jobs&JobSync != 0 {
+		var activated bool
+		activated, syncErr = syncRelease(agentConfig)
+		if activated && agentConfig.ApplyOnChange {
+			run.add(JobApply, TriggerNewRelease)
+		}
+	}
+
+	if run.jobs&JobApply != 0 {
+		applyRelease(agentConfig, syncErr)
+	} else if syncErr != nil {
+		// successful syncs are not notified, only the applies are
+		notifyRun(agentConfig, syncErr, nil)
+	}
+
+	if run.jobs&JobCheck != 0 {
+		_, err := DetectDrift(agentConfig)
+		if err != nil {
+			log.Error().Msgf("failed to detect drift: %s", err)
+		}
+	}
+
+	err := RecordTriggers(agentConfig.DataDir, startedAt, run.triggers)
+	if err != nil {
+		log.Error().Msgf("failed to record triggers: %s", err)
+	}
+}
+
+// formatTriggers joins triggers with commas
+func formatTriggers(triggers []Trigger) string {
+	names := make([]string, 0, len(triggers))
+	for _, trigger := range triggers {
+		names = append(names, string(trigger))
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// syncRelease runs DeployRepo and checks if it activated a new release
+func syncRelease(agentConfig AgentConfig) (bool, error) {
+	previousRelease, _ := ActiveRelease(agentConfig.DataDir)
 	err := DeployRepo(agentConfig)
 	if err != nil {
 		log.Error().Msgf("failed to deploy repo: %s", err)
+		return false, err
+	}
+
+	activeRelease, _ := ActiveRelease(agentConfig.DataDir)
+	return activeRelease != previousRelease, nil
+}
+
+// applyRelease runs RunActiveAnsiblePlaybook and notifies the outcome
+// of the run, including the error of the sync before it if any
+func applyRelease(agentConfig AgentConfig, syncErr error) {
+	err := RunActiveAnsiblePlaybook(agentConfig)
+	if errors.Is(err, ErrApplyDeferred) {
+		log.Info().Msg("outside the maintenance windows, deferring apply")
+		// the sync failure is not held back with the apply
+		if syncErr != nil {
+			notifyRun(agentConfig, syncErr, nil)
+		}
+
+		return
 	}
 
-	err = RunActiveAnsiblePlaybook(agentConfig)
 	if err != nil {
 		log.Error().Msgf("failed to run ansible: %s", err)
 	}
+
+	notifyRun(agentConfig, syncErr, err)
+}
+
+// notifyRun notifies the outcome of a sync and apply
+func notifyRun(agentConfig AgentConfig, syncErr, applyErr error) {
+	var result *RunResult
+	state, err := ReadState(agentConfig.DataDir)
+	if err == nil && state.LastApply != nil {
+		result = state.LastApply.Result
+	}
+
+	switch {
+	case applyErr != nil:
+		event := NewEvent(agentConfig.DataDir, EventRunFailed, result, applyErr)
+		event.Failure = applyFailure(applyErr)
+		Notify(agentConfig, event)
+	case syncErr != nil:
+		event := NewEvent(agentConfig.DataDir, EventRunFailed, nil, fmt.Errorf("sync failed: %s", syncErr))
+		event.Failure = FailureSync
+		Notify(agentConfig, event)
+	default:
+		Notify(agentConfig, NewEvent(agentConfig.DataDir, EventRunSucceeded, result, nil))
+	}
+}
+
+// applyFailure returns the failure kind of a failed apply
+func applyFailure(err error) string {
+	switch {
+	case errors.Is(err, ErrRunTimedOut):
+		return FailureTimedOut
+	case errors.Is(err, ErrRunInterrupted):
+		return FailureInterrupted
+	default:
+		return FailureApply
+	}
 }
 
-func GetDropletTags() ([]string, error) {
+// dropletMetadataURL is the base url of the DO metadata API
+var dropletMetadataURL = "http://169.254.169.254/metadata/v1"
+
+// getDropletMetadataTags returns all the tags of the droplet
+func getDropletMetadataTags(ctx context.Context) ([]string, error) {
 	dropletTags := []string{}
 
 	// get the droplet tags through the DO HTTP API
-	doTagsUrl := "http://169.254.169.254/metadata/v1/tags"
-	resp, err := http.Get(doTagsUrl)
+	doTagsUrl := dropletMetadataURL + "/tags"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, doTagsUrl, nil)
+	if err != nil {
+		return dropletTags, permanent(fmt.Errorf("could not create droplet tags request: %s", err))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return dropletTags, fmt.Errorf("could not get droplet tags: %s", err)
 	}
 
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return dropletTags, statusError("droplet tags", resp.StatusCode)
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return dropletTags, fmt.Errorf("could not read droplet tags: %b - %s", resp.StatusCode, err)
 	}
 
-	playbookTags := []string{"base"}
-	dropletTags = strings.Split(string(body), "\n")
+	return strings.Split(string(body), "\n"), nil
+}
+
+// getDropletTags returns all the tags of the droplet. Failed requests to
+// the metadata API are retried with the configured retry policy.
+func getDropletTags(agentConfig AgentConfig) ([]string, error) {
+	var dropletTags []string
+	err := retry(context.Background(), "droplet tags", retryPolicy(agentConfig, agentConfig.RemoteTimeout), func(ctx context.Context) error {
+		var err error
+		dropletTags, err = getDropletMetadataTags(ctx)
+		return err
+	})
+
+	return dropletTags, err
+}
 
+// GetDropletTags returns the playbook tags of the droplet,
+// base and the droplet tags containing ansible-. Failed requests to
+// the metadata API are retried with the configured retry policy.
+func GetDropletTags(agentConfig AgentConfig) ([]string, error) {
+	dropletTags, err := getDropletTags(agentConfig)
+	if err != nil {
+		return dropletTags, err
+	}
+
+	playbookTags := []string{"base"}
 	for _, tag := range dropletTags {
 		if strings.Contains(tag, "ansible-") {
 			playbookTags = append(playbookTags, tag)
@@ -70,48 +356,71 @@ func GetDropletTags() ([]string, error) {
 	return playbookTags, nil
 }
 
-// RunActiveAnsiblePlaybook runs localhost inventory
-// on the base.yaml playbook in the active ansible repo
-// RunActiveAnsiblePlaybook returns an error if the ansible run fails
-func RunActiveAnsiblePlaybook(agentConfig AgentConfig) error {
-	tags, err := GetDropletTags()
+// Daemon creates the Runner struct and triggers syncs on the sync interval,
+// applies on the daemon cron schedule or interval, both delayed by the splay
+// and jitter, and drift checks on the drift interval when one is configured,
+// delayed the same way.
+// It syncs and applies once on start, after the start delay, unless disabled,
+// and whenever doan receives SIGUSR1 or a request to the trigger webhook.
+func Daemon(agentConfig AgentConfig) error {
+	runner := &Runner{}
+
+	s, err := newScheduler(agentConfig)
 	if err != nil {
 		return err
 	}
 
-	ansiblePlayBookCommand := "ansible-playbook"
-	ansiblePlayBookCommandParams := []string{
-		"/var/lib/doan/active/ansible/base.yaml",
-		"-i",
-		"/var/lib/doan/active/ansible/inventory.yaml",
-		"--vault-password-file",
-		"~/.vault_pass.txt",
-		"--tags",
-		strings.Join(tags, ","),
+	_, err = s.Every(agentConfig.SyncInterval).Do(delayed(agentConfig, func() {
+		runner.Trigger(agentConfig, JobSync, TriggerSchedule)
+	}))
+	if err != nil {
+		return fmt.Errorf("could not schedule syncs: %s", err)
 	}
 
-	cmd := exec.Command(
-		ansiblePlayBookCommand,
-		ansiblePlayBookCommandParams...,
-	)
-	cmd.Stdout = log.Logger
-	cmd.Stderr = log.Logger
-
-	err = cmd.Run()
+	err = scheduleDaemon(s, agentConfig, delayed(agentConfig, func() {
+		runner.Trigger(agentConfig, JobApply, TriggerSchedule)
+	}))
 	if err != nil {
-		return fmt.Errorf("could not run ansible: %s", err)
+		return err
 	}
 
-	log.Info().Msg("ansible run complete")
-	return nil
-}
+	if agentConfig.DriftInterval != "" {
+		// the drift checks of the fleet are spread out like syncs and applies
+		_, err = s.Every(agentConfig.DriftInterval).Do(delayed(agentConfig, func() {
+			runner.Trigger(agentConfig, JobCheck, TriggerSchedule)
+		}))
+		if err != nil {
+			return fmt.Errorf("could not schedule drift checks: %s", err)
+		}
+	}
 
-// Daemon creates the Runner struct and starts the Run function
-// in a scheduled interval
-func Daemon(agentConfig AgentConfig) {
-	runner := &Runner{}
+	if agentConfig.TriggerListenAddress != "" {
+		err = serveTriggers(agentConfig, runner)
+		if err != nil {
+			return err
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			go runner.Trigger(agentConfig, JobSync|JobApply, TriggerSignal)
+		}
+	}()
+
+	if agentConfig.DaemonRunOnStart {
+		go func() {
+			startDelay := parseOptionalDuration(agentConfig.DaemonStartDelay)
+			if startDelay > 0 {
+				log.Info().Msgf("running in %s", startDelay)
+				time.Sleep(startDelay)
+			}
+
+			runner.Trigger(agentConfig, JobSync|JobApply, TriggerStart)
+		}()
+	}
 
-	s := gocron.NewScheduler(time.UTC)
-	s.Every(agentConfig.DaemonInterval).Do(func() { runner.Run(agentConfig) })
 	s.StartBlocking()
+	return nil
 }
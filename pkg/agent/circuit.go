@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrCircuitOpen is returned instead of calling Artifactory while the
+// circuit breaker is open after repeated failures
+var ErrCircuitOpen = errors.New("artifactory circuit breaker is open")
+
+// CircuitRecord is the state of the Artifactory circuit breaker.
+// Failures counts the calls in a row that failed after all their retries,
+// the breaker opens until OpenUntil when they reach the threshold.
+type CircuitRecord struct {
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+	OpenedAt  time.Time `json:"opened_at,omitempty"`
+	OpenUntil time.Time `json:"open_until,omitempty"`
+}
+
+// Open checks if calls to Artifactory are held back at t
+func (c *CircuitRecord) Open(t time.Time) bool {
+	return c != nil && t.Before(c.OpenUntil)
+}
+
+func (c *CircuitRecord) String() string {
+	if c.Open(time.Now()) {
+		return fmt.Sprintf("circuit open until %s after %d failures: %s", c.OpenUntil.Format(time.RFC3339), c.Failures, c.LastError)
+	}
+
+	return fmt.Sprintf("%d failures in a row: %s", c.Failures, c.LastError)
+}
+
+// withCircuit calls Artifactory unless the circuit breaker is open.
+// Calls that fail with a retryable error count towards opening the breaker,
+// once it is open calls fail right away with ErrCircuitOpen until the cooldown
+// is over. The next call is then let through, and closes the breaker if it succeeds.
+func withCircuit(agentConfig AgentConfig, call func() error) error {
+	if agentConfig.CircuitBreakerThreshold <= 0 {
+		return call()
+	}
+
+	state, err := ReadState(agentConfig.DataDir)
+	if err == nil && state.Circuit.Open(time.Now()) {
+		log.Warn().Msgf("not calling artifactory until %s: %s", state.Circuit.OpenUntil.Format(time.RFC3339), state.Circuit.LastError)
+		return ErrCircuitOpen
+	}
+
+	callErr := call()
+	if callErr == nil && err == nil && state.Circuit == nil {
+		return nil
+	}
+
+	recordCircuit(agentConfig, callErr)
+	return callErr
+}
+
+// recordCircuit records the outcome of a call to Artifactory in the circuit breaker.
+// A call that got an answer, even a permanent error, closes the breaker.
+func recordCircuit(agentConfig AgentConfig, callErr error) {
+	err := updateState(agentConfig.DataDir, func(state *AgentState) {
+		if callErr == nil || !isRetryable(callErr) {
+			if state.Circuit != nil && state.Circuit.Failures >= agentConfig.CircuitBreakerThreshold {
+				log.Info().Msgf("artifactory is reachable again, closing the circuit breaker")
+			}
+
+			state.Circuit = nil
+			return
+		}
+
+		if state.Circuit == nil {
+			state.Circuit = &CircuitRecord{}
+		}
+
+		state.Circuit.Failures++
+		state.Circuit.LastError = callErr.Error()
+		if state.Circuit.Failures < agentConfig.CircuitBreakerThreshold {
+			return
+		}
+
+		cooldown := parseOptionalDuration(agentConfig.CircuitBreakerCooldown)
+		now := time.Now()
+		state.Circuit.OpenedAt = now
+		state.Circuit.OpenUntil = now.Add(cooldown)
+		log.Error().Msgf("artifactory failed %d times in a row, not calling it until %s", state.Circuit.Failures, state.Circuit.OpenUntil.Format(time.RFC3339))
+	})
+
+	if err != nil {
+		log.Error().Msgf("failed to record the circuit breaker state: %s", err)
+	}
+}
@@ -1,70 +1,408 @@
 package agent
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 
-	"github.com/rs/zerolog/log"
 	yaml "gopkg.in/yaml.v3"
 )
 
-// CLIFlags are the command line flags for the agent
-type CLIFlags struct {
-	UpdateAnsibleRepo  bool
-	JFrogCLIConfigPath string
-	AnsibleRepoPath    string
-	Init               bool
-	MaxStagingRepos    int
-	AnsibleTarballName string
-	AnsibleNameSpace   string
-	Daemon             bool
-	DaemonInterval     string
-	ConfigFilePath     string
-	Version            bool
-	LogFile            string
+const (
+	// ConfigEnvPrefix is the prefix of the environment variables
+	// that override config keys, e.g. DOAN_MAX_STAGING_REPOS
+	ConfigEnvPrefix = "DOAN_"
+	// ConfigDropInDirName is the drop-in directory next to the config file
+	ConfigDropInDirName = "conf.d"
+	// SourceDefault is the source of values taken from the built-in defaults
+	SourceDefault = "default"
+)
+
+// removedConfigKeys are config keys that are no longer supported,
+// mapped to what to use instead
+var removedConfigKeys = map[string]string{
+	"daemon": "run doan daemon instead",
 }
 
 // AgentConfig is the configuration for the agent
 type AgentConfig struct {
-	JFrogCLIConfigPath string `yaml:"jfrog_cli_config_path"`
-	AnsibleRepoPath    string `yaml:"ansible_repo_path"`
-	MaxStagingRepos    int    `yaml:"max_staging_repos"`
-	AnsibleTarballName string `yaml:"ansible_tarball_name"`
-	AnsibleNameSpace   string `yaml:"ansible_namespace"`
-	DaemonInterval     string `yaml:"daemon_interval"`
-	Daemon             bool   `yaml:"daemon"`
-	LogFile            string `yaml:"logfile"`
+	JFrogCLIConfigPath         string `yaml:"jfrog_cli_config_path"`
+	JFrogServerID              string `yaml:"jfrog_server_id"`
+	ArtifactoryURL             string `yaml:"artifactory_url"`
+	ArtifactoryUser            string `yaml:"artifactory_user"`
+	ArtifactoryToken           string `yaml:"artifactory_token" secret:"true"`
+	ArtifactoryRefreshToken    string `yaml:"artifactory_refresh_token" secret:"true"`
+	ArtifactoryCredentialsFile string `yaml:"artifactory_credentials_file"`
+	DataDir                    string `yaml:"data_dir"`
+	AnsibleRepoPath            string `yaml:"ansible_repo_path"`
+	MaxStagingRepos            int    `yaml:"max_staging_repos"`
+	AnsibleTarballName         string `yaml:"ansible_tarball_name"`
+	AnsibleNameSpace           string `yaml:"ansible_namespace"`
+	RetryAttempts              int    `yaml:"retry_attempts"`
+	RetryBaseDelay             string `yaml:"retry_base_delay"`
+	RetryMaxDelay              string `yaml:"retry_max_delay"`
+	RemoteTimeout              string `yaml:"remote_timeout"`
+	DownloadTimeout            string `yaml:"download_timeout"`
+	StreamExtract              bool   `yaml:"stream_extract"`
+	DeltaUpdates               bool   `yaml:"delta_updates"`
+	DedupeReleases             bool   `yaml:"dedupe_releases"`
+	GalaxyTimeout              string `yaml:"galaxy_timeout"`
+	RolloutIdentity            string `yaml:"rollout_identity"`
+	CircuitBreakerThreshold    int    `yaml:"circuit_breaker_threshold"`
+	CircuitBreakerCooldown     string `yaml:"circuit_breaker_cooldown"`
+	DaemonInterval             string `yaml:"daemon_interval"`
+	SyncInterval               string `yaml:"sync_interval"`
+	ApplyOnChange              bool   `yaml:"apply_on_change"`
+	DaemonSchedule             string `yaml:"daemon_schedule"`
+	DaemonTimezone             string `yaml:"daemon_timezone"`
+	DaemonSplay                string `yaml:"daemon_splay"`
+	DaemonJitter               string `yaml:"daemon_jitter"`
+	DaemonRunOnStart           bool   `yaml:"daemon_run_on_start"`
+	DaemonStartDelay           string `yaml:"daemon_start_delay"`
+	LogFile                    string `yaml:"logfile"`
+	LeaseArtifactPath          string `yaml:"lease_artifact_path"`
+	LeaseSlots                 int    `yaml:"lease_slots"`
+	LeaseTTL                   string `yaml:"lease_ttl"`
+	DryRun                     bool   `yaml:"dry_run"`
+	LockTimeout                string `yaml:"lock_timeout"`
+	RunTimeout                 string `yaml:"run_timeout"`
+	RunInactivityTimeout       string `yaml:"run_inactivity_timeout"`
+	MaintenanceWindows         string `yaml:"maintenance_windows"`
+	MaintenanceTimezone        string `yaml:"maintenance_timezone"`
+	TriggerListenAddress       string `yaml:"trigger_listen_address"`
+	TriggerToken               string `yaml:"trigger_token" secret:"true"`
+	DriftInterval              string `yaml:"drift_interval"`
+	DriftMetricsFile           string `yaml:"drift_metrics_file"`
+	NotifyEvents               string `yaml:"notify_events"`
+	NotifyWebhookURL           string `yaml:"notify_webhook_url"`
+	NotifyWebhookHeaders       string `yaml:"notify_webhook_headers" secret:"true"`
+	NotifyWebhookTemplate      string `yaml:"notify_webhook_template"`
+	NotifySyslog               bool   `yaml:"notify_syslog"`
+	NotifyCommand              string `yaml:"notify_command"`
+	HookPreSync                string `yaml:"hook_pre_sync"`
+	HookPostSync               string `yaml:"hook_post_sync"`
+	HookPreActivate            string `yaml:"hook_pre_activate"`
+	HookPreApply               string `yaml:"hook_pre_apply"`
+	HookPostApply              string `yaml:"hook_post_apply"`
+	HookOnFailure              string `yaml:"hook_on_failure"`
+	HookTimeout                string `yaml:"hook_timeout"`
+}
+
+// ConfigSources maps each config key to the layer its value came from
+type ConfigSources map[string]string
+
+// DefaultAgentConfig returns the built-in defaults of the agent config
+func DefaultAgentConfig() AgentConfig {
+	return AgentConfig{
+		JFrogCLIConfigPath:      "$HOME/.jfrog/jfrog-cli.conf",
+		DataDir:                 DefaultDataDir(),
+		AnsibleRepoPath:         "generic-repo/path/to/tar",
+		MaxStagingRepos:         10,
+		GalaxyTimeout:           "10m",
+		RolloutIdentity:         HostIdentityAuto,
+		AnsibleTarballName:      "ansible.tar.gz",
+		AnsibleNameSpace:        "ansible",
+		RetryAttempts:           4,
+		RetryBaseDelay:          "1s",
+		RetryMaxDelay:           "30s",
+		RemoteTimeout:           "30s",
+		DownloadTimeout:         "10m",
+		CircuitBreakerThreshold: 3,
+		CircuitBreakerCooldown:  "5m",
+		DaemonInterval:          "1m",
+		SyncInterval:            "1m",
+		ApplyOnChange:           true,
+		DaemonTimezone:          "UTC",
+		DaemonRunOnStart:        true,
+		LeaseTTL:                "30m",
+		HookTimeout:             "5m",
+		RunTimeout:              "1h",
+		MaintenanceTimezone:     "UTC",
+	}
+}
+
+// ConfigKeys returns the config keys in the order they are declared
+func ConfigKeys() []string {
+	t := reflect.TypeOf(AgentConfig{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		keys = append(keys, configKey(t.Field(i)))
+	}
+
+	return keys
+}
+
+// IsConfigKey checks if key is a config key
+func IsConfigKey(key string) bool {
+	_, ok := configField(key)
+	return ok
+}
+
+// IsSecretConfigKey checks if the value of key must not be printed
+func IsSecretConfigKey(key string) bool {
+	field, ok := configField(key)
+	return ok && field.Tag.Get("secret") == "true"
+}
+
+// ConfigEnvName returns the environment variable overriding key
+func ConfigEnvName(key string) string {
+	return ConfigEnvPrefix + strings.ToUpper(key)
+}
+
+// configKey returns the yaml key of a config field
+func configKey(field reflect.StructField) string {
+	key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	return key
+}
+
+// configField returns the struct field of a config key
+func configField(key string) (reflect.StructField, bool) {
+	t := reflect.TypeOf(AgentConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		if configKey(t.Field(i)) == key {
+			return t.Field(i), true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+// Value returns the value of a config key
+func (c *AgentConfig) Value(key string) interface{} {
+	field, ok := configField(key)
+	if !ok {
+		return nil
+	}
+
+	return reflect.ValueOf(c).Elem().FieldByIndex(field.Index).Interface()
+}
+
+// Set parses value into the config key
+func (c *AgentConfig) Set(key, value string) error {
+	field, ok := configField(key)
+	if !ok {
+		return fmt.Errorf("unknown config key %s", key)
+	}
+
+	v := reflect.ValueOf(c).Elem().FieldByIndex(field.Index)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+
+		v.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("cannot be set from a string")
+	}
+
+	return nil
 }
 
-func (c *AgentConfig) WithConfigFromFile(configFilePath string) *AgentConfig {
-	var ac AgentConfig
+// decodeConfigFile decodes a YAML config file over the config
+// and records the file and line of the keys it sets in sources.
+// Unknown keys and values of the wrong type are returned as ConfigErrors.
+func (c *AgentConfig) decodeConfigFile(configFilePath string, sources ConfigSources) error {
+	content, err := os.ReadFile(configFilePath)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %s", err)
+	}
 
-	file, err := os.Open(configFilePath)
+	var document yaml.Node
+	err = yaml.Unmarshal(content, &document)
 	if err != nil {
-		log.Error().Msgf("failed to open config file: %s", err)
-		return c
+		return fmt.Errorf("could not decode config file %s: %s", configFilePath, err)
+	}
+
+	// an empty file holds no document
+	if len(document.Content) == 0 {
+		return nil
+	}
+
+	mapping := document.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: config must be a mapping of keys to values", configFilePath, mapping.Line)
 	}
 
-	defer file.Close()
+	var configErrors ConfigErrors
+	err = document.Decode(c)
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		// type errors are prefixed with the line of the offending value
+		for _, message := range typeError.Errors {
+			var line int
+			_, scanErr := fmt.Sscanf(message, "line %d:", &line)
+			if scanErr == nil {
+				message = strings.TrimSpace(message[strings.Index(message, ":")+1:])
+			}
+
+			configErrors = append(configErrors, ConfigError{
+				Key:     configKeyAtLine(mapping, line),
+				Source:  fmt.Sprintf("%s:%d", configFilePath, line),
+				Message: message,
+			})
+		}
+	} else if err != nil {
+		return fmt.Errorf("could not decode config file %s: %s", configFilePath, err)
+	}
+
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		keyNode := mapping.Content[i]
+		location := fmt.Sprintf("%s:%d", configFilePath, keyNode.Line)
+		if !IsConfigKey(keyNode.Value) {
+			message := "unknown field"
+			if replacement, ok := removedConfigKeys[keyNode.Value]; ok {
+				message = "no longer supported, " + replacement
+			}
+
+			configErrors = append(configErrors, ConfigError{
+				Key:     keyNode.Value,
+				Source:  location,
+				Message: message,
+			})
+			continue
+		}
+
+		sources[keyNode.Value] = location
+	}
+
+	if len(configErrors) > 0 {
+		return configErrors
+	}
+
+	return nil
+}
+
+// configKeyAtLine returns the key of the mapping whose value starts at line
+func configKeyAtLine(mapping *yaml.Node, line int) string {
+	key := ""
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i+1].Line <= line {
+			key = mapping.Content[i].Value
+		}
+	}
+
+	return key
+}
+
+// ConfigDropInFiles returns the YAML files in the drop-in directory
+// next to the config file in lexical order
+func ConfigDropInFiles(configFilePath string) ([]string, error) {
+	dropInDir := filepath.Join(filepath.Dir(configFilePath), ConfigDropInDirName)
+	entries, err := os.ReadDir(dropInDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 
-	decoder := yaml.NewDecoder(file)
-	err = decoder.Decode(&ac)
 	if err != nil {
-		log.Error().Msgf("failed to decode config file: %s", err)
+		return nil, fmt.Errorf("could not read drop-in directory: %s", err)
 	}
 
-	return &ac
+	files := []string{}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		files = append(files, filepath.Join(dropInDir, entry.Name()))
+	}
+
+	sort.Strings(files)
+	return files, nil
 }
 
-// NewConfig returns a new Config struct from the command line flags
-func (c *AgentConfig) WithConfigFromCLI(agentFlags CLIFlags) *AgentConfig {
-	c.JFrogCLIConfigPath = agentFlags.JFrogCLIConfigPath
-	c.AnsibleRepoPath = agentFlags.AnsibleRepoPath
-	c.MaxStagingRepos = agentFlags.MaxStagingRepos
-	c.AnsibleTarballName = agentFlags.AnsibleTarballName
-	c.AnsibleNameSpace = agentFlags.AnsibleNameSpace
-	c.DaemonInterval = agentFlags.DaemonInterval
-	c.Daemon = agentFlags.Daemon
-	c.LogFile = agentFlags.LogFile
+// LoadAgentConfig builds the agent config from its layers. Each layer
+// overrides the previous one: the built-in defaults, the config file,
+// the drop-in files next to it, DOAN_* environment variables
+// and finally the config keys explicitly set on the command line.
+// Unknown keys and invalid values are returned as ConfigErrors.
+func LoadAgentConfig(configFilePath string, overrides map[string]string) (*AgentConfig, ConfigSources, error) {
+	agentConfig := DefaultAgentConfig()
+	sources := ConfigSources{}
+	for _, key := range ConfigKeys() {
+		sources[key] = SourceDefault
+	}
+
+	if configFilePath != "" {
+		configFiles := []string{configFilePath}
+		dropInFiles, err := ConfigDropInFiles(configFilePath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// collect unknown keys of every file before failing
+		var configErrors ConfigErrors
+		for _, configFile := range append(configFiles, dropInFiles...) {
+			err = agentConfig.decodeConfigFile(configFile, sources)
+			if fileErrors, ok := err.(ConfigErrors); ok {
+				configErrors = append(configErrors, fileErrors...)
+			} else if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if len(configErrors) > 0 {
+			return nil, nil, configErrors
+		}
+	}
+
+	for _, key := range ConfigKeys() {
+		envName := ConfigEnvName(key)
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+
+		err := agentConfig.Set(key, value)
+		if err != nil {
+			return nil, nil, ConfigErrors{{Key: key, Source: "env " + envName, Message: err.Error()}}
+		}
+
+		sources[key] = "env " + envName
+	}
+
+	for _, key := range ConfigKeys() {
+		value, ok := overrides[key]
+		if !ok {
+			continue
+		}
+
+		err := agentConfig.Set(key, value)
+		if err != nil {
+			return nil, nil, ConfigErrors{{Key: key, Source: "flag -" + ConfigFlagName(key), Message: err.Error()}}
+		}
+
+		sources[key] = "flag -" + ConfigFlagName(key)
+	}
+
+	err := agentConfig.Validate(sources)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &agentConfig, sources, nil
+}
+
+// ConfigFlagName returns the command line flag of a config key
+func ConfigFlagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
 
-	return c
+// ConfigKeyFromFlag returns the config key of a command line flag
+func ConfigKeyFromFlag(flagName string) string {
+	return strings.ReplaceAll(flagName, "-", "_")
 }
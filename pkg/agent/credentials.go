@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// NativeServerID is the server ID of the credentials configured in doan
+	// itself, it keys the refreshed tokens of those credentials
+	NativeServerID = "doan"
+)
+
+// ArtifactoryCredentials are the Artifactory credentials configured
+// in doan itself instead of the JFrog CLI config
+type ArtifactoryCredentials struct {
+	URL          string `yaml:"url"`
+	User         string `yaml:"user"`
+	Token        string `yaml:"token"`
+	RefreshToken string `yaml:"refresh_token"`
+}
+
+// overlay replaces the credentials with the non-empty fields of other
+func (c ArtifactoryCredentials) overlay(other ArtifactoryCredentials) ArtifactoryCredentials {
+	if other.URL != "" {
+		c.URL = other.URL
+	}
+
+	if other.User != "" {
+		c.User = other.User
+	}
+
+	if other.Token != "" {
+		c.Token = other.Token
+	}
+
+	if other.RefreshToken != "" {
+		c.RefreshToken = other.RefreshToken
+	}
+
+	return c
+}
+
+// ReadCredentialsFile reads Artifactory credentials from a YAML file.
+// The file must be owned by the user running doan and
+// must not be accessible by the group or others.
+func ReadCredentialsFile(credentialsFilePath string) (ArtifactoryCredentials, error) {
+	var credentials ArtifactoryCredentials
+
+	info, err := os.Stat(credentialsFilePath)
+	if err != nil {
+		return credentials, fmt.Errorf("could not stat credentials file: %s", err)
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		return credentials, fmt.Errorf("credentials file %s has permissions %#o, it must not be accessible by the group or others", credentialsFilePath, info.Mode().Perm())
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok && int(stat.Uid) != os.Geteuid() {
+		return credentials, fmt.Errorf("credentials file %s is owned by uid %d, it must be owned by uid %d", credentialsFilePath, stat.Uid, os.Geteuid())
+	}
+
+	content, err := os.ReadFile(credentialsFilePath)
+	if err != nil {
+		return credentials, fmt.Errorf("could not read credentials file: %s", err)
+	}
+
+	err = yaml.Unmarshal(content, &credentials)
+	if err != nil {
+		return credentials, fmt.Errorf("could not unmarshal credentials file: %s", err)
+	}
+
+	return credentials, nil
+}
+
+// GetArtifactoryCredentials returns the credentials configured in doan.
+// The credentials file is overridden by the agent config.
+func GetArtifactoryCredentials(agentConfig AgentConfig) (ArtifactoryCredentials, error) {
+	var credentials ArtifactoryCredentials
+	if agentConfig.ArtifactoryCredentialsFile != "" {
+		fileCredentials, err := ReadCredentialsFile(agentConfig.ArtifactoryCredentialsFile)
+		if err != nil {
+			return credentials, err
+		}
+
+		credentials = fileCredentials
+	}
+
+	credentials = credentials.overlay(ArtifactoryCredentials{
+		URL:          agentConfig.ArtifactoryURL,
+		User:         agentConfig.ArtifactoryUser,
+		Token:        agentConfig.ArtifactoryToken,
+		RefreshToken: agentConfig.ArtifactoryRefreshToken,
+	})
+
+	return credentials, nil
+}
+
+// GetArtifactoryServer returns the JFrog server to connect to.
+// Credentials configured in doan take precedence over the JFrog CLI config,
+// which is only read when no Artifactory URL is configured in doan.
+func GetArtifactoryServer(agentConfig AgentConfig) (JFrogServers, error) {
+	credentials, err := GetArtifactoryCredentials(agentConfig)
+	if err != nil {
+		return JFrogServers{}, err
+	}
+
+	if credentials.URL == "" {
+		jfrogCLIConfig, err := ReadJFrogCLIConfig(agentConfig.JFrogCLIConfigPath)
+		if err != nil {
+			return JFrogServers{}, err
+		}
+
+		return jfrogCLIConfig.SelectServer(agentConfig.JFrogServerID)
+	}
+
+	// a refresh token alone is exchanged for an access token on first use
+	if credentials.Token == "" && credentials.RefreshToken == "" {
+		return JFrogServers{}, fmt.Errorf("artifactory url is configured without a token or refresh token")
+	}
+
+	if credentials.RefreshToken == "" && tokenNeedsRefresh(credentials.Token) {
+		log.Warn().Msg("artifactory token is about to expire and no refresh token is configured")
+	}
+
+	return JFrogServers{
+		ServerID:                NativeServerID,
+		ArtifactoryURL:          credentials.URL,
+		User:                    credentials.User,
+		AccessToken:             credentials.Token,
+		ArtifactoryRefreshToken: credentials.RefreshToken,
+	}, nil
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetArtifactoryServer(t *testing.T) {
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.yml")
+	err := os.WriteFile(credentialsFile, []byte("url: https://artifactory.example.com/artifactory\nrefresh_token: file-refresh\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config AgentConfig
+		want   JFrogServers
+		err    bool
+	}{
+		{
+			name:   "token",
+			config: AgentConfig{ArtifactoryURL: "https://artifactory.example.com/artifactory", ArtifactoryToken: "access"},
+			want:   JFrogServers{ServerID: NativeServerID, ArtifactoryURL: "https://artifactory.example.com/artifactory", AccessToken: "access"},
+		},
+		{
+			name:   "refresh token only",
+			config: AgentConfig{ArtifactoryURL: "https://artifactory.example.com/artifactory", ArtifactoryRefreshToken: "refresh"},
+			want:   JFrogServers{ServerID: NativeServerID, ArtifactoryURL: "https://artifactory.example.com/artifactory", ArtifactoryRefreshToken: "refresh"},
+		},
+		{
+			name:   "refresh token from the credentials file",
+			config: AgentConfig{ArtifactoryCredentialsFile: credentialsFile},
+			want:   JFrogServers{ServerID: NativeServerID, ArtifactoryURL: "https://artifactory.example.com/artifactory", ArtifactoryRefreshToken: "file-refresh"},
+		},
+		{
+			name:   "no token",
+			config: AgentConfig{ArtifactoryURL: "https://artifactory.example.com/artifactory", ArtifactoryUser: "doan"},
+			err:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, err := GetArtifactoryServer(test.config)
+			if test.err {
+				if err == nil {
+					t.Fatal("got a server without credentials")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("could not get server: %s", err)
+			}
+
+			if server != test.want {
+				t.Errorf("got %+v, expected %+v", server, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jfrog/jfrog-client-go/artifactory/services/utils"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// FileManifestName is the name of the file manifest
+	// that is looked up next to the tarball in Artifactory
+	FileManifestName = "doan-files.json"
+	// ObjectsDirName is the directory next to the tarball in Artifactory
+	// holding the files of the bundle named by their sha256
+	ObjectsDirName = "objects"
+)
+
+// FileManifest lists the directories and files of a bundle for delta updates.
+// Release is the sha256 or md5 of the tarball the manifest describes.
+type FileManifest struct {
+	Release string         `json:"release"`
+	Dirs    []ManifestDir  `json:"dirs"`
+	Files   []ManifestFile `json:"files"`
+}
+
+// ManifestDir is a directory of a bundle, Path is relative to the bundle root.
+// Directories are listed so empty ones are created too.
+type ManifestDir struct {
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"mode"`
+}
+
+// ManifestFile is a regular file of a bundle, Path is relative to the bundle root
+type ManifestFile struct {
+	Path   string      `json:"path"`
+	SHA256 string      `json:"sha256"`
+	Mode   os.FileMode `json:"mode"`
+	Size   int64       `json:"size"`
+}
+
+// describes checks if the manifest was published for the tarball
+func (m *FileManifest) describes(artifact utils.ResultItem) bool {
+	return m.Release != "" && (strings.EqualFold(m.Release, artifact.Sha256) || strings.EqualFold(m.Release, artifact.Actual_Md5))
+}
+
+// complete checks if the manifest lists the directories of the bundle,
+// manifests published before directories were listed may miss empty ones
+func (m *FileManifest) complete() bool {
+	return m.Dirs != nil
+}
+
+// validManifestPath checks that a path of the manifest stays within the release
+func validManifestPath(manifestPath string) bool {
+	cleaned := filepath.Clean(manifestPath)
+	return manifestPath != "" && cleaned != "." && !filepath.IsAbs(cleaned) && cleaned != ".." && !strings.HasPrefix(cleaned, "../")
+}
+
+// validate checks that the directories and files of the manifest stay
+// within the release and the files are named by a sha256
+func (m *FileManifest) validate() error {
+	for _, dir := range m.Dirs {
+		if !validManifestPath(dir.Path) {
+			return fmt.Errorf("invalid directory path %q in file manifest", dir.Path)
+		}
+	}
+
+	for _, file := range m.Files {
+		if !validManifestPath(file.Path) {
+			return fmt.Errorf("invalid file path %q in file manifest", file.Path)
+		}
+
+		_, err := hex.DecodeString(file.SHA256)
+		if err != nil || len(file.SHA256) != sha256.Size*2 {
+			return fmt.Errorf("invalid sha256 %q of %s in file manifest", file.SHA256, file.Path)
+		}
+	}
+
+	return nil
+}
+
+// ComputeFileManifest returns the manifest of the directories and regular files in dir
+func ComputeFileManifest(dir string) (*FileManifest, error) {
+	manifest := &FileManifest{Dirs: []ManifestDir{}, Files: []ManifestFile{}}
+	err := filepath.WalkDir(dir, func(filePath string, entry os.DirEntry, err error) error {
+		if err != nil || filePath == dir {
+			return err
+		}
+
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			manifest.Dirs = append(manifest.Dirs, ManifestDir{
+				Path: filepath.ToSlash(relPath),
+				Mode: info.Mode().Perm(),
+			})
+
+			return nil
+		}
+
+		sha256Sum, err := HashFile(filePath)
+		if err != nil {
+			return err
+		}
+
+		manifest.Files = append(manifest.Files, ManifestFile{
+			Path:   filepath.ToSlash(relPath),
+			SHA256: sha256Sum,
+			Mode:   info.Mode().Perm(),
+			Size:   info.Size(),
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("could not compute file manifest of %s: %s", dir, err)
+	}
+
+	return manifest, nil
+}
+
+// WriteObjects copies the files of the manifest from dir to objectsDir,
+// named by their sha256, ready to be uploaded next to the tarball
+func WriteObjects(dir string, manifest *FileManifest, objectsDir string) error {
+	err := os.MkdirAll(objectsDir, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create directory %s: %s", objectsDir, err)
+	}
+
+	for _, file := range manifest.Files {
+		err = copyFile(filepath.Join(dir, filepath.FromSlash(file.Path)), filepath.Join(objectsDir, file.SHA256), file.Mode)
+		if err != nil {
+			return fmt.Errorf("could not write object of %s: %s", file.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// artifactSibling returns the path of name next to the artifact in Artifactory
+func artifactSibling(artifact utils.ResultItem, name ...string) string {
+	return path.Join(append([]string{artifact.Repo, artifact.Path}, name...)...)
+}
+
+// GetFileManifest downloads the file manifest published next to the tarball.
+// It returns nil if there is no file manifest in Artifactory.
+func GetFileManifest(agentConfig AgentConfig, artifact utils.ResultItem) (*FileManifest, error) {
+	var manifest *FileManifest
+	err := withCircuit(agentConfig, func() error {
+		return retry(context.Background(), "file manifest", retryPolicy(agentConfig, agentConfig.RemoteTimeout), func(ctx context.Context) error {
+			var err error
+			manifest, err = getFileManifest(ctx, agentConfig, artifact)
+			return err
+		})
+	})
+
+	return manifest, err
+}
+
+func getFileManifest(ctx context.Context, agentConfig AgentConfig, artifact utils.ResultItem) (*FileManifest, error) {
+	client, req, err := newDownloadRequest(ctx, agentConfig, artifactSibling(artifact, FileManifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not download file manifest: %s", err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError("file manifest", resp.StatusCode)
+	}
+
+	var manifest FileManifest
+	err = json.NewDecoder(resp.Body).Decode(&manifest)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("could not unmarshal file manifest: %s", err))
+	}
+
+	err = manifest.validate()
+	if err != nil {
+		return nil, permanent(err)
+	}
+
+	return &manifest, nil
+}
+
+// fetchObject downloads the object of the file into the object store
+// and verifies its sha256 before it can be linked
+func fetchObject(ctx context.Context, agentConfig AgentConfig, artifact utils.ResultItem, file ManifestFile) error {
+	object := objectPath(agentConfig.DataDir, file.SHA256, file.Mode)
+	err := os.MkdirAll(filepath.Dir(object), 0755)
+	if err != nil {
+		return permanent(fmt.Errorf("could not create directory %s: %s", filepath.Dir(object), err))
+	}
+
+	client, req, err := newDownloadRequest(ctx, agentConfig, artifactSibling(artifact, ObjectsDirName, file.SHA256))
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not download object of %s: %s", file.Path, err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError("object of "+file.Path, resp.StatusCode)
+	}
+
+	partialPath := object + ".part"
+	out, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode.Perm())
+	if err != nil {
+		return permanent(fmt.Errorf("could not create %s: %s", partialPath, err))
+	}
+
+	defer os.Remove(partialPath)
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not download object of %s: %s", file.Path, err)
+	}
+
+	actual := fmt.Sprintf("%x", h.Sum(nil))
+	if actual != file.SHA256 {
+		return fmt.Errorf("sha256 of the object of %s is %s, expected %s", file.Path, actual, file.SHA256)
+	}
+
+	// the umask may have masked the mode
+	err = os.Chmod(partialPath, file.Mode.Perm())
+	if err == nil {
+		err = os.Rename(partialPath, object)
+	}
+
+	if err != nil {
+		return permanent(fmt.Errorf("could not promote the object of %s: %s", file.Path, err))
+	}
+
+	// the object was hashed while it was downloaded
+	info, err := os.Stat(object)
+	if err == nil {
+		markVerified(object, info)
+	}
+
+	return nil
+}
+
+// stageDelta assembles the release described by the manifest in destination.
+// Files already in the object store are hardlinked, only the other files are
+// downloaded from the objects next to the tarball. The release is removed
+// if any file cannot be fetched, so it is never activated.
+func stageDelta(agentConfig AgentConfig, artifact utils.ResultItem, manifest *FileManifest, destination string) error {
+	err := os.MkdirAll(destination, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create destination directory: %s", err)
+	}
+
+	err = withCircuit(agentConfig, func() error {
+		return assembleRelease(agentConfig, artifact, manifest, destination)
+	})
+
+	if err != nil {
+		os.RemoveAll(destination)
+		return err
+	}
+
+	return nil
+}
+
+// assembleRelease creates the directories of the manifest in destination and links
+// its files into them, fetching the objects missing from the object store
+func assembleRelease(agentConfig AgentConfig, artifact utils.ResultItem, manifest *FileManifest, destination string) error {
+	// directories are listed before the directories and files in them
+	for _, dir := range manifest.Dirs {
+		dirPath := filepath.Join(destination, filepath.FromSlash(dir.Path))
+		err := os.MkdirAll(dirPath, dir.Mode.Perm())
+		if err != nil {
+			return permanent(fmt.Errorf("could not create directory %s: %s", dirPath, err))
+		}
+	}
+
+	fetched := 0
+	var fetchedBytes int64
+	for _, file := range manifest.Files {
+		filePath := filepath.Join(destination, filepath.FromSlash(file.Path))
+		err := linkObject(agentConfig.DataDir, file.SHA256, file.Mode, filePath)
+		if errors.Is(err, errObjectMissing) {
+			err = retry(context.Background(), "object download", retryPolicy(agentConfig, agentConfig.DownloadTimeout), func(ctx context.Context) error {
+				return fetchObject(ctx, agentConfig, artifact, file)
+			})
+
+			if err != nil {
+				return err
+			}
+
+			fetched++
+			fetchedBytes += file.Size
+			err = linkObject(agentConfig.DataDir, file.SHA256, file.Mode, filePath)
+		}
+
+		if err != nil {
+			// a local failure says nothing about Artifactory
+			return permanent(err)
+		}
+	}
+
+	log.Info().Msgf("assembled %d files of tarball %s, downloaded %d files (%d bytes)", len(manifest.Files), ArtifactDigest(artifact), fetched, fetchedBytes)
+	return nil
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DriftRecord is the outcome of the last drift check of the active release.
+// A failed check has no changed tasks, whether the host drifted is unknown.
+type DriftRecord struct {
+	CheckedAt    time.Time `json:"checked_at"`
+	Release      string    `json:"release"`
+	CheckFailed  bool      `json:"check_failed"`
+	ChangedTasks []string  `json:"changed_tasks,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Drifted checks if the host differs from the active release
+func (d *DriftRecord) Drifted() bool {
+	return d != nil && !d.CheckFailed && len(d.ChangedTasks) > 0
+}
+
+// DetectDrift runs the active release in check mode and records
+// the tasks that would change as drift, without applying anything.
+// A drifted host is logged as a warning and exposed in the drift metrics file.
+func DetectDrift(agentConfig AgentConfig) (*DriftRecord, error) {
+	release, err := ActiveRelease(agentConfig.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	drift := &DriftRecord{
+		CheckedAt: time.Now(),
+		Release:   release,
+	}
+
+	result, err := RunAnsiblePlaybook(agentConfig, PlaybookOptions{Check: true})
+	if err != nil {
+		drift.CheckFailed = true
+		drift.Error = err.Error()
+	} else {
+		drift.ChangedTasks = result.ChangedTasks
+	}
+
+	stateErr := updateState(agentConfig.DataDir, func(state *AgentState) {
+		state.Drift = drift
+	})
+
+	if stateErr != nil {
+		log.Error().Msgf("failed to record drift: %s", stateErr)
+	}
+
+	if agentConfig.DriftMetricsFile != "" {
+		metricsErr := WriteDriftMetrics(agentConfig.DriftMetricsFile, drift)
+		if metricsErr != nil {
+			log.Error().Msgf("failed to write drift metrics: %s", metricsErr)
+		}
+	}
+
+	if err != nil {
+		return drift, err
+	}
+
+	if drift.Drifted() {
+		log.Warn().Str("release", release).Strs("tasks", drift.ChangedTasks).Msgf("host drifted from the active release, %d tasks would change", len(drift.ChangedTasks))
+	} else {
+		log.Info().Str("release", release).Msg("no drift from the active release")
+	}
+
+	return drift, nil
+}
+
+// WriteDriftMetrics writes the drift record in the Prometheus text format,
+// to be picked up by the node exporter textfile collector
+func WriteDriftMetrics(metricsFile string, drift *DriftRecord) error {
+	checkFailed := 0
+	if drift.CheckFailed {
+		checkFailed = 1
+	}
+
+	// a failed check leaves out the changed tasks instead of reporting none
+	var b strings.Builder
+	fmt.Fprintln(&b, "# HELP doan_drift_changed_tasks Number of tasks that would change when applying the active release.")
+	fmt.Fprintln(&b, "# TYPE doan_drift_changed_tasks gauge")
+	if !drift.CheckFailed {
+		fmt.Fprintf(&b, "doan_drift_changed_tasks{release=%q} %d\n", drift.Release, len(drift.ChangedTasks))
+	}
+
+	fmt.Fprintln(&b, "# HELP doan_drift_check_failed Whether the last drift check failed.")
+	fmt.Fprintln(&b, "# TYPE doan_drift_check_failed gauge")
+	fmt.Fprintf(&b, "doan_drift_check_failed %d\n", checkFailed)
+	fmt.Fprintln(&b, "# HELP doan_drift_last_check_timestamp_seconds Unix time of the last drift check.")
+	fmt.Fprintln(&b, "# TYPE doan_drift_last_check_timestamp_seconds gauge")
+	fmt.Fprintf(&b, "doan_drift_last_check_timestamp_seconds %d\n", drift.CheckedAt.Unix())
+
+	// write to a temp file first so the collector never reads a partial file
+	tmpFile := metricsFile + ".tmp"
+	err := os.WriteFile(tmpFile, []byte(b.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("could not write metrics file: %s", err)
+	}
+
+	return os.Rename(tmpFile, metricsFile)
+}
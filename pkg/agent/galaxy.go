@@ -0,0 +1,361 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// GalaxyRequirementsFile declares the roles and collections
+	// a bundle needs from Ansible Galaxy
+	GalaxyRequirementsFile = "requirements.yml"
+
+	// galaxyDirName is the directory in a release
+	// the galaxy requirements are installed to
+	galaxyDirName = ".doan-galaxy"
+
+	// galaxyInstalledFile marks a release whose galaxy requirements are installed
+	galaxyInstalledFile = ".installed"
+
+	// ansible looks for roles and collections in these paths
+	// when ANSIBLE_ROLES_PATH and ANSIBLE_COLLECTIONS_PATH are not set
+	defaultAnsibleRolesPath       = "~/.ansible/roles:/usr/share/ansible/roles:/etc/ansible/roles"
+	defaultAnsibleCollectionsPath = "~/.ansible/collections:/usr/share/ansible/collections"
+)
+
+var (
+	// semverPattern matches exact semantic versions like 1.2.3, v1.2.3 or 1.2.3-rc.1
+	semverPattern = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+	// commitPattern matches full and abbreviated git commit shas
+	commitPattern = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+)
+
+// galaxyRequirementsPaths are the paths in a release, in order,
+// that are looked up for the galaxy requirements
+var galaxyRequirementsPaths = []string{
+	GalaxyRequirementsFile,
+	filepath.Join("ansible", GalaxyRequirementsFile),
+}
+
+// galaxyRequirement is a role or collection of a requirements file,
+// kind is roles or collections and node the entry as it was declared
+type galaxyRequirement struct {
+	kind string
+	node *yaml.Node
+}
+
+// field returns the value of a key of the entry, a string entry is its name
+func (r galaxyRequirement) field(key string) string {
+	if r.node.Kind == yaml.ScalarNode {
+		if key == "name" {
+			return r.node.Value
+		}
+
+		return ""
+	}
+
+	for i := 0; i+1 < len(r.node.Content); i += 2 {
+		if r.node.Content[i].Value == key {
+			return r.node.Content[i+1].Value
+		}
+	}
+
+	return ""
+}
+
+func (r galaxyRequirement) String() string {
+	name := r.field("name")
+	if name == "" {
+		name = r.field("src")
+	}
+
+	if version := r.version(); version != "" {
+		return name + " " + version
+	}
+
+	return name
+}
+
+// version returns the version the entry asks for, roles
+// can also be declared as "src,version" in the legacy format
+func (r galaxyRequirement) version() string {
+	if r.kind == "roles" && r.node.Kind == yaml.ScalarNode {
+		_, version, _ := strings.Cut(r.node.Value, ",")
+		return strings.TrimSpace(version)
+	}
+
+	return r.field("version")
+}
+
+// pinned checks if the entry asks for one exact version, a semver or a commit
+// sha, only those are kept in the offline cache. Branches and other git refs
+// move, so they are installed again for every release.
+func (r galaxyRequirement) pinned() bool {
+	version := r.version()
+	return semverPattern.MatchString(version) || commitPattern.MatchString(version)
+}
+
+// cacheKey returns the name of the entry in the offline cache,
+// the sha256 of the entry so another source or version is another entry
+func (r galaxyRequirement) cacheKey() (string, error) {
+	content, err := yaml.Marshal(r.node)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal %s: %s", r, err)
+	}
+
+	return fmt.Sprintf("%s-%x", r.kind, sha256.Sum256(content)), nil
+}
+
+// install runs ansible-galaxy installing the entry and its dependencies into
+// destination, from dir so relative sources resolve against the requirements file
+func (r galaxyRequirement) install(ctx context.Context, dir, destination string) error {
+	tmpDir, err := os.MkdirTemp("", "doan-galaxy-")
+	if err != nil {
+		return fmt.Errorf("could not create temp directory: %s", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	content, err := yaml.Marshal(map[string][]*yaml.Node{r.kind: {r.node}})
+	if err != nil {
+		return fmt.Errorf("could not marshal %s: %s", r, err)
+	}
+
+	requirementsPath := filepath.Join(tmpDir, GalaxyRequirementsFile)
+	err = os.WriteFile(requirementsPath, content, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write %s: %s", requirementsPath, err)
+	}
+
+	subcommand := "role"
+	if r.kind == "collections" {
+		subcommand = "collection"
+	}
+
+	log.Info().Msgf("installing %s %s from ansible galaxy", strings.TrimSuffix(r.kind, "s"), r)
+	activity := &activityWriter{w: log.Logger}
+	cmd := exec.Command("ansible-galaxy", subcommand, "install", "-r", requirementsPath, "-p", destination)
+	cmd.Dir = dir
+	cmd.Stdout = activity
+	cmd.Stderr = activity
+
+	// the git and tar processes started by ansible-galaxy are stopped with it
+	err = runProcessGroup(ctx, cmd, activity, 0)
+	if errors.Is(err, ErrRunTimedOut) {
+		return fmt.Errorf("ansible-galaxy timed out")
+	}
+
+	if err != nil {
+		return fmt.Errorf("ansible-galaxy failed: %s", err)
+	}
+
+	return nil
+}
+
+// readGalaxyRequirements reads the requirements file of a release and returns
+// its path and entries. A release without a requirements file has no entries.
+func readGalaxyRequirements(releasePath string) (string, []galaxyRequirement, error) {
+	for _, relPath := range galaxyRequirementsPaths {
+		requirementsPath := filepath.Join(releasePath, relPath)
+		content, err := os.ReadFile(requirementsPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return "", nil, fmt.Errorf("could not read galaxy requirements: %s", err)
+		}
+
+		requirements, err := parseGalaxyRequirements(content)
+		if err != nil {
+			return "", nil, fmt.Errorf("could not parse %s: %s", relPath, err)
+		}
+
+		return requirementsPath, requirements, nil
+	}
+
+	return "", nil, nil
+}
+
+// parseGalaxyRequirements parses a requirements file, either a list of roles
+// or a mapping with roles and collections lists
+func parseGalaxyRequirements(content []byte) ([]galaxyRequirement, error) {
+	var document yaml.Node
+	err := yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(document.Content) == 0 {
+		return nil, nil
+	}
+
+	lists := map[string]*yaml.Node{}
+	root := document.Content[0]
+	switch root.Kind {
+	case yaml.SequenceNode:
+		lists["roles"] = root
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			lists[root.Content[i].Value] = root.Content[i+1]
+		}
+	default:
+		return nil, fmt.Errorf("expected a list of roles or a mapping of roles and collections")
+	}
+
+	var requirements []galaxyRequirement
+	for _, kind := range []string{"roles", "collections"} {
+		list, ok := lists[kind]
+		if !ok || list.Kind == yaml.ScalarNode && list.Tag == "!!null" {
+			continue
+		}
+
+		if list.Kind != yaml.SequenceNode {
+			return nil, fmt.Errorf("expected %s to be a list", kind)
+		}
+
+		for _, node := range list.Content {
+			requirements = append(requirements, galaxyRequirement{kind: kind, node: node})
+		}
+	}
+
+	return requirements, nil
+}
+
+// installGalaxyRequirements installs the roles and collections of the release's
+// requirements file into the release. Pinned versions are installed from the
+// offline cache, and added to it the first time they are installed. A release
+// is only installed once, a partial install is removed so the release cannot run.
+func installGalaxyRequirements(agentConfig AgentConfig, releasePath string) error {
+	requirementsPath, requirements, err := readGalaxyRequirements(releasePath)
+	if err != nil || len(requirements) == 0 {
+		return err
+	}
+
+	galaxyDir := filepath.Join(releasePath, galaxyDirName)
+	installedPath := filepath.Join(galaxyDir, galaxyInstalledFile)
+	if _, err := os.Stat(installedPath); err == nil {
+		return nil
+	}
+
+	// a previous install may have stopped halfway
+	err = os.RemoveAll(galaxyDir)
+	if err != nil {
+		return fmt.Errorf("could not remove %s: %s", galaxyDir, err)
+	}
+
+	ctx := context.Background()
+	timeout := parseOptionalDuration(agentConfig.GalaxyTimeout)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cached := 0
+	startedAt := time.Now()
+	for _, requirement := range requirements {
+		fromCache, err := installGalaxyRequirement(ctx, agentConfig, requirement, filepath.Dir(requirementsPath), filepath.Join(galaxyDir, requirement.kind))
+		if err != nil {
+			os.RemoveAll(galaxyDir)
+			return fmt.Errorf("could not install galaxy requirement %s: %s", requirement, err)
+		}
+
+		if fromCache {
+			cached++
+		}
+	}
+
+	err = os.WriteFile(installedPath, nil, 0644)
+	if err != nil {
+		os.RemoveAll(galaxyDir)
+		return fmt.Errorf("could not write %s: %s", installedPath, err)
+	}
+
+	log.Info().Msgf("installed %d galaxy requirements, %d from the offline cache, in %s", len(requirements), cached, time.Since(startedAt).Round(time.Second))
+	return nil
+}
+
+// installGalaxyRequirement installs a requirement into destination, copying it
+// from the offline cache when it is pinned and reports whether it was cached
+func installGalaxyRequirement(ctx context.Context, agentConfig AgentConfig, requirement galaxyRequirement, dir, destination string) (bool, error) {
+	if !requirement.pinned() {
+		return false, requirement.install(ctx, dir, destination)
+	}
+
+	key, err := requirement.cacheKey()
+	if err != nil {
+		return false, err
+	}
+
+	cachePath := filepath.Join(GalaxyCacheDir(agentConfig.DataDir), key)
+	_, err = os.Stat(cachePath)
+	fromCache := err == nil
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(GalaxyCacheDir(agentConfig.DataDir), 0755)
+		if err != nil {
+			return false, fmt.Errorf("could not create directory %s: %s", GalaxyCacheDir(agentConfig.DataDir), err)
+		}
+
+		// install next to the cache entry so it only appears once complete
+		tmpPath, err := os.MkdirTemp(GalaxyCacheDir(agentConfig.DataDir), key+".tmp-")
+		if err != nil {
+			return false, fmt.Errorf("could not create temp directory: %s", err)
+		}
+
+		err = requirement.install(ctx, dir, tmpPath)
+		if err == nil {
+			err = os.Rename(tmpPath, cachePath)
+		}
+
+		if err != nil {
+			os.RemoveAll(tmpPath)
+			return false, err
+		}
+	} else if err != nil {
+		return false, fmt.Errorf("could not stat %s: %s", cachePath, err)
+	}
+
+	err = copyTree(cachePath, destination)
+	if err != nil {
+		return false, fmt.Errorf("could not copy %s from the offline cache: %s", requirement, err)
+	}
+
+	return fromCache, nil
+}
+
+// galaxyEnv returns the environment pointing ansible at the roles
+// and collections installed in the release, ahead of the other paths
+func galaxyEnv(releasePath string) []string {
+	galaxyDir := filepath.Join(releasePath, galaxyDirName)
+	if _, err := os.Stat(filepath.Join(galaxyDir, galaxyInstalledFile)); err != nil {
+		return nil
+	}
+
+	return []string{
+		"ANSIBLE_ROLES_PATH=" + prependPath(filepath.Join(galaxyDir, "roles"), "ANSIBLE_ROLES_PATH", defaultAnsibleRolesPath),
+		"ANSIBLE_COLLECTIONS_PATH=" + prependPath(filepath.Join(galaxyDir, "collections"), "ANSIBLE_COLLECTIONS_PATH", defaultAnsibleCollectionsPath),
+	}
+}
+
+// prependPath returns dir followed by the paths in the environment variable,
+// or by the default paths when it is not set
+func prependPath(dir, variable, defaultPaths string) string {
+	paths := os.Getenv(variable)
+	if paths == "" {
+		paths = defaultPaths
+	}
+
+	return dir + ":" + paths
+}
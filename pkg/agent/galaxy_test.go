@@ -0,0 +1,37 @@
+package agent
+
+import "testing"
+
+func TestGalaxyRequirementPinned(t *testing.T) {
+	tests := []struct {
+		requirements string
+		want         bool
+	}{
+		{"collections:\n  - name: community.general\n    version: 8.1.0", true},
+		{"collections:\n  - name: community.general\n    version: 1.0.0-rc.1+build.5", true},
+		{"collections:\n  - name: community.general\n    version: \">=8.0.0,<9.0.0\"", false},
+		{"collections:\n  - name: community.general\n    version: \"*\"", false},
+		{"collections:\n  - name: community.general", false},
+		{"roles:\n  - src: https://github.com/acme/ansible-role-nginx\n    version: v2.3.1", true},
+		{"roles:\n  - src: https://github.com/acme/ansible-role-nginx\n    version: 3f2a9c1", true},
+		{"roles:\n  - src: https://github.com/acme/ansible-role-nginx\n    version: 3f2a9c1d0e8b7a6f5e4d3c2b1a0f9e8d7c6b5a49", true},
+		{"roles:\n  - src: https://github.com/acme/ansible-role-nginx\n    version: main", false},
+		{"roles:\n  - src: https://github.com/acme/ansible-role-nginx\n    version: release/2.3", false},
+		{"roles:\n  - src: https://github.com/acme/ansible-role-nginx\n    version: latest", false},
+		{"- https://github.com/acme/ansible-role-nginx,v2.3.1", true},
+		{"- https://github.com/acme/ansible-role-nginx,develop", false},
+	}
+
+	for _, test := range tests {
+		requirements, err := parseGalaxyRequirements([]byte(test.requirements))
+		if err != nil || len(requirements) != 1 {
+			t.Errorf("could not parse %q: %v", test.requirements, err)
+			continue
+		}
+
+		got := requirements[0].pinned()
+		if got != test.want {
+			t.Errorf("%s: got pinned %t, expected %t", requirements[0], got, test.want)
+		}
+	}
+}
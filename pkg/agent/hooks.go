@@ -0,0 +1,227 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// HookPreSync runs before a sync, a failure aborts the sync
+	HookPreSync = "pre_sync"
+	// HookPostSync runs after a sync, whether it failed or not
+	HookPostSync = "post_sync"
+	// HookPreActivate runs before a new release is linked as active,
+	// a failure aborts the relink
+	HookPreActivate = "pre_activate"
+	// HookPreApply runs before an apply, a failure aborts the apply
+	HookPreApply = "pre_apply"
+	// HookPostApply runs after an apply, whether it failed or not
+	HookPostApply = "post_apply"
+	// HookOnFailure runs when a sync or apply failed
+	HookOnFailure = "on_failure"
+
+	// BundleHooksFile is the file in the root of a release
+	// declaring the hooks of the bundle
+	BundleHooksFile = "doan-hooks.yaml"
+)
+
+// BundleHooks are the hook commands declared by a bundle
+type BundleHooks struct {
+	PreSync     string `yaml:"pre_sync"`
+	PostSync    string `yaml:"post_sync"`
+	PreActivate string `yaml:"pre_activate"`
+	PreApply    string `yaml:"pre_apply"`
+	PostApply   string `yaml:"post_apply"`
+	OnFailure   string `yaml:"on_failure"`
+}
+
+// command returns the command of a hook
+func (h BundleHooks) command(hook string) string {
+	switch hook {
+	case HookPreSync:
+		return h.PreSync
+	case HookPostSync:
+		return h.PostSync
+	case HookPreActivate:
+		return h.PreActivate
+	case HookPreApply:
+		return h.PreApply
+	case HookPostApply:
+		return h.PostApply
+	case HookOnFailure:
+		return h.OnFailure
+	}
+
+	return ""
+}
+
+// HookContext describes the release and run a hook is run for
+type HookContext struct {
+	// Step is the step the hook is run around, sync, activate or apply
+	Step            string
+	ReleasePath     string
+	PreviousRelease string
+	// Err is the error of the step for post and failure hooks
+	Err error
+}
+
+// env returns the environment variables describing the release and run
+func (c HookContext) env(hook string) []string {
+	release := filepath.Base(c.ReleasePath)
+	target, err := filepath.EvalSymlinks(c.ReleasePath)
+	if err == nil {
+		release = filepath.Base(target)
+	}
+
+	status := "succeeded"
+	errorMessage := ""
+	if c.Err != nil {
+		status = "failed"
+		errorMessage = c.Err.Error()
+	}
+
+	host, _ := os.Hostname()
+	return append(os.Environ(),
+		"DOAN_HOOK="+hook,
+		"DOAN_STEP="+c.Step,
+		"DOAN_HOST="+host,
+		"DOAN_RELEASE="+release,
+		"DOAN_RELEASE_PATH="+c.ReleasePath,
+		"DOAN_PREVIOUS_RELEASE="+c.PreviousRelease,
+		"DOAN_STATUS="+status,
+		"DOAN_ERROR="+errorMessage,
+	)
+}
+
+// ReadBundleHooks reads the hooks declared by a release.
+// A release without a hooks file declares no hooks.
+func ReadBundleHooks(releasePath string) (BundleHooks, error) {
+	var hooks BundleHooks
+	content, err := os.ReadFile(filepath.Join(releasePath, BundleHooksFile))
+	if os.IsNotExist(err) {
+		return hooks, nil
+	}
+
+	if err != nil {
+		return hooks, fmt.Errorf("could not read bundle hooks: %s", err)
+	}
+
+	err = yaml.Unmarshal(content, &hooks)
+	if err != nil {
+		return hooks, fmt.Errorf("could not unmarshal bundle hooks: %s", err)
+	}
+
+	return hooks, nil
+}
+
+// configHookCommand returns the command of a hook in the agent config
+func configHookCommand(agentConfig AgentConfig, hook string) string {
+	switch hook {
+	case HookPreSync:
+		return agentConfig.HookPreSync
+	case HookPostSync:
+		return agentConfig.HookPostSync
+	case HookPreActivate:
+		return agentConfig.HookPreActivate
+	case HookPreApply:
+		return agentConfig.HookPreApply
+	case HookPostApply:
+		return agentConfig.HookPostApply
+	case HookOnFailure:
+		return agentConfig.HookOnFailure
+	}
+
+	return ""
+}
+
+// RunHook runs the command of a hook from the agent config
+// and then the one declared by the release, if any.
+// RunHook returns an error if a command fails or times out.
+func RunHook(agentConfig AgentConfig, hook string, hookContext HookContext) error {
+	err := runHookCommand(agentConfig, hook, configHookCommand(agentConfig, hook), "", hookContext)
+	if err != nil {
+		return err
+	}
+
+	bundleHooks, err := ReadBundleHooks(hookContext.ReleasePath)
+	if err != nil {
+		return err
+	}
+
+	return runHookCommand(agentConfig, hook, bundleHooks.command(hook), hookContext.ReleasePath, hookContext)
+}
+
+// runHookCommand runs a hook command with the shell in dir
+func runHookCommand(agentConfig AgentConfig, hook, command, dir string, hookContext HookContext) error {
+	if command == "" {
+		return nil
+	}
+
+	timeout, err := time.ParseDuration(agentConfig.HookTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid hook timeout: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.Info().Str("hook", hook).Str("dir", dir).Msgf("running hook: %s", command)
+	activity := &activityWriter{w: log.Logger}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = hookContext.env(hook)
+	cmd.Stdout = activity
+	cmd.Stderr = activity
+
+	// the commands started by the hook are stopped with it on timeout
+	err = runProcessGroup(ctx, cmd, activity, 0)
+	if errors.Is(err, ErrRunTimedOut) {
+		return fmt.Errorf("%s hook timed out after %s", hook, timeout)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %s", hook, err)
+	}
+
+	return nil
+}
+
+// runStepHooks runs a sync or apply step between its pre and post hooks.
+// A failing pre hook aborts the step, post hooks always run and
+// the failure hook runs when the pre hook or the step failed.
+func runStepHooks(agentConfig AgentConfig, step, releasePath string, run func() error) error {
+	preHook, postHook := HookPreSync, HookPostSync
+	if step == "apply" {
+		preHook, postHook = HookPreApply, HookPostApply
+	}
+
+	hookContext := HookContext{Step: step, ReleasePath: releasePath}
+	err := RunHook(agentConfig, preHook, hookContext)
+	if err == nil {
+		err = run()
+
+		hookContext.Err = err
+		postErr := RunHook(agentConfig, postHook, hookContext)
+		if postErr != nil {
+			log.Error().Msgf("failed to run %s hook: %s", postHook, postErr)
+		}
+	}
+
+	if err != nil {
+		hookContext.Err = err
+		failureErr := RunHook(agentConfig, HookOnFailure, hookContext)
+		if failureErr != nil {
+			log.Error().Msgf("failed to run %s hook: %s", HookOnFailure, failureErr)
+		}
+	}
+
+	return err
+}
@@ -3,22 +3,80 @@ package agent
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
 const (
-	// DoanWorkingDir is the working directory for the agent
+	// DoanWorkingDir is the working directory of the agent running as root
 	DoanWorkingDir = "/var/lib/doan"
-	DoanTarBallDir = DoanWorkingDir + "/tarballs"
-	DoanStagingDir = DoanWorkingDir + "/staging"
-	DoanActiveDir  = DoanWorkingDir + "/active"
 )
 
+// DefaultDataDir returns the working directory of the agent, DoanWorkingDir
+// for root and a per-user directory for unprivileged users
+func DefaultDataDir() string {
+	if os.Geteuid() == 0 {
+		return DoanWorkingDir
+	}
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return DoanWorkingDir
+		}
+
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+
+	return filepath.Join(dataHome, "doan")
+}
+
+// TarBallDir returns the directory the tarballs are downloaded to
+func TarBallDir(dataDir string) string {
+	return filepath.Join(dataDir, "tarballs")
+}
+
+// StagingDir returns the directory the releases are staged in
+func StagingDir(dataDir string) string {
+	return filepath.Join(dataDir, "staging")
+}
+
+// ActiveDir returns the symlink to the active release
+func ActiveDir(dataDir string) string {
+	return filepath.Join(dataDir, "active")
+}
+
+// ObjectsDir returns the content-addressed store of release files
+func ObjectsDir(dataDir string) string {
+	return filepath.Join(dataDir, "objects")
+}
+
+// GalaxyCacheDir returns the offline cache of the pinned galaxy requirements
+func GalaxyCacheDir(dataDir string) string {
+	return filepath.Join(dataDir, "galaxy")
+}
+
+// tokenCacheFile returns the file holding the access tokens refreshed by the agent
+func tokenCacheFile(dataDir string) string {
+	return filepath.Join(dataDir, "tokens.json")
+}
+
+// stateFile returns the file holding the outcome of the last sync and apply
+func stateFile(dataDir string) string {
+	return filepath.Join(dataDir, "state.json")
+}
+
+// lockFile returns the file locked by the doan process syncing or applying
+func lockFile(dataDir string) string {
+	return filepath.Join(dataDir, "doan.lock")
+}
+
 // Init creates the directories needed for the agent
-func initDir() error {
+func initDir(dataDir string) error {
 	doanDirectories := []string{
-		DoanWorkingDir,
-		DoanTarBallDir,
-		DoanStagingDir,
+		dataDir,
+		TarBallDir(dataDir),
+		StagingDir(dataDir),
 	}
 
 	for _, dir := range doanDirectories {
@@ -32,7 +90,7 @@ func initDir() error {
 }
 
 func Init(agentConfig AgentConfig) error {
-	err := initDir()
+	err := initDir(agentConfig.DataDir)
 	if err != nil {
 		return err
 	}
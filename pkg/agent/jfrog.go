@@ -2,65 +2,47 @@ package agent
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
-	"os"
+	"net/http"
+	"strings"
 
 	"github.com/jfrog/jfrog-client-go/artifactory"
 	"github.com/jfrog/jfrog-client-go/artifactory/services"
 	"github.com/jfrog/jfrog-client-go/artifactory/services/utils"
 	"github.com/jfrog/jfrog-client-go/auth"
+	"github.com/jfrog/jfrog-client-go/auth/cert"
 	"github.com/jfrog/jfrog-client-go/config"
 	"github.com/rs/zerolog/log"
 
 	aritfactoryAuth "github.com/jfrog/jfrog-client-go/artifactory/auth"
 )
 
-type JFrogServers struct {
-	AccessToken       string `json:"accessToken"`
-	ArtifactoryURL    string `json:"artifactoryUrl"`
-	DistributionURL   string `json:"distributionUrl"`
-	IsDefault         bool   `json:"isDefault"`
-	MissionControlURL string `json:"missionControlUrl"`
-	PipelinesURL      string `json:"pipelinesUrl"`
-	ServerID          string `json:"serverId"`
-	URL               string `json:"url"`
-	User              string `json:"user"`
-	XrayURL           string `json:"xrayUrl"`
-}
-
-// JFrogCLIConfig is the JSON structure of the JFrog CLI config file
-// usually located at ~/.jfrog/jfrog-cli.conf
-type JFrogCLIConfig struct {
-	Servers []JFrogServers `json:"servers"`
-	Version string         `json:"version"`
-}
+// defaultHttpRetries is the number of times jfrog-client-go retries a failed
+// request of a call that doan does not retry itself
+const defaultHttpRetries = 3
 
-// NewRtDetailsFromConfig returns auth.ServiceDetails using the JFrog CLI config.
-// Requires the JFrog CLI to be installed and configured.
-// Returns an error if the Artifactory details cannot be set.
-func NewRtDetailsFromConfig(jFrogCLIConfigPath string) (auth.ServiceDetails, error) {
+// NewRtDetailsFromServer returns auth.ServiceDetails for a JFrog server,
+// authenticating with its access token, password or API key in that order.
+func NewRtDetailsFromServer(server JFrogServers) (auth.ServiceDetails, error) {
 	rtDetails := aritfactoryAuth.NewArtifactoryDetails()
-	// Read JFrog CLI Config JSON file from the JFrogCLIConfigPath parm
-	content, err := os.ReadFile(jFrogCLIConfigPath)
-	if err != nil {
-		log.Error().Msgf("failed to read JFrogCLIConfig: %v", err)
-		return rtDetails, err
-	}
-
-	// Unmarshal the JSON file into a JFrogCLIConfig struct
-	var jfrogCLIConfig JFrogCLIConfig
-	err = json.Unmarshal(content, &jfrogCLIConfig)
-	if err != nil {
-		log.Error().Msgf("failed to unmarshal JFrogCLIConfig: %v", err)
-		return rtDetails, err
+	if server.ArtifactoryURL == "" {
+		return rtDetails, fmt.Errorf("server %s has no artifactory url", server.ServerID)
 	}
 
-	// Set the Artifactory details from the JFrogCLIConfig struct
-	server := jfrogCLIConfig.Servers[0]
-	rtDetails.SetUrl(server.ArtifactoryURL)
+	rtDetails.SetUrl(strings.TrimSuffix(server.ArtifactoryURL, "/") + "/")
 	rtDetails.SetUser(server.User)
-	rtDetails.SetAccessToken(server.AccessToken)
+
+	switch {
+	case server.AccessToken != "":
+		rtDetails.SetAccessToken(server.AccessToken)
+	case server.Password != "":
+		rtDetails.SetPassword(server.Password)
+	case server.APIKey != "":
+		rtDetails.SetApiKey(server.APIKey)
+	default:
+		return rtDetails, fmt.Errorf("server %s has no credentials", server.ServerID)
+	}
 
 	return rtDetails, nil
 }
@@ -68,22 +50,89 @@ func NewRtDetailsFromConfig(jFrogCLIConfigPath string) (auth.ServiceDetails, err
 // CreateArtifactoryServicesManager retuns an ArtifactoryServicesManager struct
 // that is used to interact with Artifactory. It returns an error if
 // the ArtifactoryServicesManager cannot be created.
-func CreateArtifactoryServicesManager(jfrogCliConfigPath string) (artifactory.ArtifactoryServicesManager, error) {
+func CreateArtifactoryServicesManager(agentConfig AgentConfig) (artifactory.ArtifactoryServicesManager, error) {
+	return createArtifactoryServicesManager(context.TODO(), agentConfig, defaultHttpRetries)
+}
+
+// createArtifactoryServicesManager returns an ArtifactoryServicesManager whose requests
+// are bound to ctx, retrying failed requests httpRetries times
+func createArtifactoryServicesManager(ctx context.Context, agentConfig AgentConfig, httpRetries int) (artifactory.ArtifactoryServicesManager, error) {
 	var accessManager artifactory.ArtifactoryServicesManager
-	rtDetails, err := NewRtDetailsFromConfig(jfrogCliConfigPath)
+	rtDetails, err := artifactoryDetails(agentConfig)
 	if err != nil {
-		log.Error().Msgf("failed to create Auth Details: %v", err)
 		return accessManager, err
 	}
 
-	ctx := context.TODO()
+	return newArtifactoryServicesManager(ctx, rtDetails, httpRetries)
+}
+
+// artifactoryDetails returns the details of the configured Artifactory server
+// with a fresh access token
+func artifactoryDetails(agentConfig AgentConfig) (auth.ServiceDetails, error) {
+	server, err := GetArtifactoryServer(agentConfig)
+	if err != nil {
+		log.Error().Msgf("failed to get Artifactory server: %v", err)
+		return nil, err
+	}
+
+	// Swap in a fresh access token if the server has a refresh token
+	server, err = RefreshServerTokens(agentConfig.DataDir, server)
+	if err != nil {
+		log.Error().Msgf("failed to refresh access token of server %s: %v", server.ServerID, err)
+	}
+
+	rtDetails, err := NewRtDetailsFromServer(server)
+	if err != nil {
+		log.Error().Msgf("failed to create Auth Details: %v", err)
+		return nil, err
+	}
+
+	return rtDetails, nil
+}
+
+// setArtifactoryAuth authenticates req with the details
+// the same way jfrog-client-go authenticates its requests
+func setArtifactoryAuth(req *http.Request, rtDetails auth.ServiceDetails) {
+	details := rtDetails.CreateHttpClientDetails()
+	for name, value := range details.Headers {
+		req.Header.Set(name, value)
+	}
+
+	switch {
+	case details.ApiKey != "" && details.User != "":
+		req.SetBasicAuth(details.User, details.ApiKey)
+	case details.ApiKey != "":
+		req.Header.Set("X-JFrog-Art-Api", details.ApiKey)
+	case details.AccessToken != "" && details.User != "":
+		req.SetBasicAuth(details.User, details.AccessToken)
+	case details.AccessToken != "":
+		req.Header.Set("Authorization", "Bearer "+details.AccessToken)
+	case details.Password != "":
+		req.SetBasicAuth(details.User, details.Password)
+	}
+}
+
+// newArtifactoryServiceConfig returns the jfrog-client-go service config for the given details
+func newArtifactoryServiceConfig(ctx context.Context, rtDetails auth.ServiceDetails, httpRetries int) (config.Config, error) {
 	serviceConfig, err := config.NewConfigBuilder().
 		SetServiceDetails(rtDetails).
 		SetContext(ctx).
+		SetHttpRetries(httpRetries).
 		Build()
 
 	if err != nil {
 		log.Error().Msgf("failed to create Artifactory Service Config: %v", err)
+		return nil, err
+	}
+
+	return serviceConfig, nil
+}
+
+// newArtifactoryServicesManager returns an ArtifactoryServicesManager for the given details
+func newArtifactoryServicesManager(ctx context.Context, rtDetails auth.ServiceDetails, httpRetries int) (artifactory.ArtifactoryServicesManager, error) {
+	var accessManager artifactory.ArtifactoryServicesManager
+	serviceConfig, err := newArtifactoryServiceConfig(ctx, rtDetails, httpRetries)
+	if err != nil {
 		return accessManager, err
 	}
 
@@ -96,38 +145,91 @@ func CreateArtifactoryServicesManager(jfrogCliConfigPath string) (artifactory.Ar
 	return accessManager, nil
 }
 
-// DownloadRepo downloads the latest Ansible Repo tarball from Artifactory
-// and returns an error if the download fails.
-func DownloadRepo(agentConfig AgentConfig) error {
-	rtManager, err := CreateArtifactoryServicesManager(agentConfig.JFrogCLIConfigPath)
-	if err != nil {
-		return err
+// newArtifactoryHTTPClient returns an http.Client for the requests doan sends to
+// Artifactory itself, with the proxy, certificates and client certificate
+// jfrog-client-go uses for the service config
+func newArtifactoryHTTPClient(serviceConfig config.Config) (*http.Client, error) {
+	if serviceConfig.GetHttpClient() != nil {
+		return serviceConfig.GetHttpClient(), nil
 	}
 
-	// Download Ansible Tarball from Artifactory via JFrog CLI
-	params := services.NewDownloadParams()
-	params.Pattern = agentConfig.AnsibleRepoPath
-	params.Target = fmt.Sprintf("%s/%s", DoanTarBallDir, agentConfig.AnsibleTarballName)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
 
-	totalDownloaded, totalFailed, err := rtManager.DownloadFiles(params)
-	if err != nil {
-		return err
+	if serviceConfig.GetCertificatesPath() != "" {
+		var err error
+		transport, err = cert.GetTransportWithLoadedCert(serviceConfig.GetCertificatesPath(), serviceConfig.IsInsecureTls(), transport)
+		if err != nil {
+			return nil, fmt.Errorf("could not load certificates from %s: %s", serviceConfig.GetCertificatesPath(), err)
+		}
+	} else {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: serviceConfig.IsInsecureTls()}
 	}
 
-	if totalFailed > 0 {
-		log.Error().Msgf("failed to download %d files", totalFailed)
-		return nil
+	rtDetails := serviceConfig.GetServiceDetails()
+	if rtDetails.GetClientCertPath() != "" {
+		certificate, err := cert.LoadCertificate(rtDetails.GetClientCertPath(), rtDetails.GetClientCertKeyPath())
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate %s: %s", rtDetails.GetClientCertPath(), err)
+		}
+
+		transport.TLSClientConfig.Certificates = []tls.Certificate{certificate}
 	}
 
-	log.Info().Msgf("downloaded %d files", totalDownloaded)
-	return nil
+	return &http.Client{Transport: transport}, nil
+}
+
+// DownloadRepo downloads the tarball found in Artifactory into the tarball cache
+// and returns its path there, or an error if the download fails. Failed downloads
+// are retried with the configured retry policy and the download timeout,
+// and resumed where the previous attempt stopped.
+func DownloadRepo(agentConfig AgentConfig, artifact utils.ResultItem) (string, error) {
+	var tarballPath string
+	err := withCircuit(agentConfig, func() error {
+		return retry(context.Background(), "download", retryPolicy(agentConfig, agentConfig.DownloadTimeout), func(ctx context.Context) error {
+			var err error
+			tarballPath, err = downloadTarball(ctx, agentConfig, artifact)
+			return err
+		})
+	})
+
+	return tarballPath, err
+}
+
+// StreamRepo extracts the tarball found in Artifactory into destination while
+// downloading it, without keeping the tarball on disk. It returns an error if the
+// download fails or the tarball does not match its checksums, destination
+// is removed then. Failed attempts are retried from the start with the
+// configured retry policy and the download timeout.
+func StreamRepo(agentConfig AgentConfig, artifact utils.ResultItem, destination string) error {
+	return withCircuit(agentConfig, func() error {
+		return retry(context.Background(), "streaming download", retryPolicy(agentConfig, agentConfig.DownloadTimeout), func(ctx context.Context) error {
+			return streamTarball(ctx, agentConfig, artifact, destination)
+		})
+	})
+}
+
+// GetRemoteArtifact returns the search result for the tarball in Artifactory,
+// including its checksums and properties. Failed searches are retried
+// with the configured retry policy and the remote timeout.
+func GetRemoteArtifact(agentConfig AgentConfig) (utils.ResultItem, error) {
+	var artifact utils.ResultItem
+	err := withCircuit(agentConfig, func() error {
+		return retry(context.Background(), "search", retryPolicy(agentConfig, agentConfig.RemoteTimeout), func(ctx context.Context) error {
+			var err error
+			artifact, err = getRemoteArtifact(ctx, agentConfig)
+			return err
+		})
+	})
+
+	return artifact, err
 }
 
-// GetRemoteMD5Sum checks the MD5 sum of the tarball in Artifactory
-func GetRemoteMD5Sum(agentConfig AgentConfig) (string, error) {
-	rtManager, err := CreateArtifactoryServicesManager(agentConfig.JFrogCLIConfigPath)
+func getRemoteArtifact(ctx context.Context, agentConfig AgentConfig) (utils.ResultItem, error) {
+	var artifact utils.ResultItem
+	rtManager, err := createArtifactoryServicesManager(ctx, agentConfig, 0)
 	if err != nil {
-		return "", fmt.Errorf("failed to create Artifactory Services Manager: %v", err)
+		return artifact, permanent(fmt.Errorf("failed to create Artifactory Services Manager: %v", err))
 	}
 
 	params := services.NewSearchParams()
@@ -135,22 +237,21 @@ func GetRemoteMD5Sum(agentConfig AgentConfig) (string, error) {
 
 	reader, err := rtManager.SearchFiles(params)
 	if err != nil {
-		return "", err
+		return artifact, err
 	}
 
 	defer reader.Close()
 
 	err = reader.GetError()
 	if err != nil {
-		return "", err
+		return artifact, err
 	}
 
-	var md5sum string
 	for currentResult := new(utils.ResultItem); reader.NextRecord(currentResult) == nil; currentResult = new(utils.ResultItem) {
 		log.Debug().Msgf("Found artifact: %s of type: %s\n md5:%s", currentResult.Name, currentResult.Type, currentResult.Actual_Md5)
-		md5sum = currentResult.Actual_Md5
+		artifact = *currentResult
 		break
 	}
 
-	return md5sum, nil
+	return artifact, nil
 }
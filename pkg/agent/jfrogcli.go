@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// JFrogCLIEncryptionKeyEnv is the environment variable the JFrog CLI
+	// reads the master key of an encrypted config from
+	JFrogCLIEncryptionKeyEnv = "JFROG_CLI_ENCRYPTION_KEY"
+	// jfrogCLISecurityFile is the file holding the master key,
+	// relative to the directory of the JFrog CLI config
+	jfrogCLISecurityFile = "security/security.yaml"
+)
+
+// JFrogServers is a server entry in the JFrog CLI config
+type JFrogServers struct {
+	AccessToken             string `json:"accessToken"`
+	APIKey                  string `json:"apiKey"`
+	ArtifactoryRefreshToken string `json:"artifactoryRefreshToken"`
+	ArtifactoryURL          string `json:"artifactoryUrl"`
+	DistributionURL         string `json:"distributionUrl"`
+	IsDefault               bool   `json:"isDefault"`
+	MissionControlURL       string `json:"missionControlUrl"`
+	Password                string `json:"password"`
+	PipelinesURL            string `json:"pipelinesUrl"`
+	RefreshToken            string `json:"refreshToken"`
+	ServerID                string `json:"serverId"`
+	URL                     string `json:"url"`
+	User                    string `json:"user"`
+	XrayURL                 string `json:"xrayUrl"`
+}
+
+// JFrogCLIConfig is the JSON structure of the JFrog CLI config file
+// usually located at ~/.jfrog/jfrog-cli.conf
+type JFrogCLIConfig struct {
+	Servers []JFrogServers `json:"servers"`
+	Version string         `json:"version"`
+	Enc     bool           `json:"enc"`
+}
+
+// jfrogCLISecurityConfig is the YAML structure of the JFrog CLI security file
+type jfrogCLISecurityConfig struct {
+	Version   string `yaml:"version"`
+	MasterKey string `yaml:"masterKey"`
+}
+
+// ReadJFrogCLIConfig reads the JFrog CLI config file and
+// decrypts its secrets if the config is encrypted
+func ReadJFrogCLIConfig(jFrogCLIConfigPath string) (JFrogCLIConfig, error) {
+	var jfrogCLIConfig JFrogCLIConfig
+
+	jFrogCLIConfigPath = os.ExpandEnv(jFrogCLIConfigPath)
+	content, err := os.ReadFile(jFrogCLIConfigPath)
+	if err != nil {
+		return jfrogCLIConfig, fmt.Errorf("could not read %s: %s", jFrogCLIConfigPath, err)
+	}
+
+	err = json.Unmarshal(content, &jfrogCLIConfig)
+	if err != nil {
+		return jfrogCLIConfig, fmt.Errorf("could not unmarshal %s: %s", jFrogCLIConfigPath, err)
+	}
+
+	if !jfrogCLIConfig.Enc {
+		return jfrogCLIConfig, nil
+	}
+
+	key, err := getJFrogCLIEncryptionKey(jFrogCLIConfigPath)
+	if err != nil {
+		return jfrogCLIConfig, err
+	}
+
+	for i := range jfrogCLIConfig.Servers {
+		err = decryptJFrogServer(&jfrogCLIConfig.Servers[i], key)
+		if err != nil {
+			return jfrogCLIConfig, fmt.Errorf("could not decrypt server %s: %s", jfrogCLIConfig.Servers[i].ServerID, err)
+		}
+	}
+
+	jfrogCLIConfig.Enc = false
+	return jfrogCLIConfig, nil
+}
+
+// SelectServer returns the server with the given ID, or the default
+// server if no ID is given. A config holding a single server
+// is used regardless of its default flag.
+func (c JFrogCLIConfig) SelectServer(serverID string) (JFrogServers, error) {
+	if len(c.Servers) == 0 {
+		return JFrogServers{}, fmt.Errorf("no servers configured in the JFrog CLI config")
+	}
+
+	if serverID != "" {
+		for _, server := range c.Servers {
+			if server.ServerID == serverID {
+				return server, nil
+			}
+		}
+
+		return JFrogServers{}, fmt.Errorf("server %s not found in the JFrog CLI config", serverID)
+	}
+
+	for _, server := range c.Servers {
+		if server.IsDefault {
+			return server, nil
+		}
+	}
+
+	if len(c.Servers) == 1 {
+		return c.Servers[0], nil
+	}
+
+	return JFrogServers{}, fmt.Errorf("no default server in the JFrog CLI config, set a server id")
+}
+
+// getJFrogCLIEncryptionKey returns the master key of an encrypted JFrog CLI config
+// from the environment or from the security file next to the config
+func getJFrogCLIEncryptionKey(jFrogCLIConfigPath string) (string, error) {
+	if key := os.Getenv(JFrogCLIEncryptionKeyEnv); key != "" {
+		return key, nil
+	}
+
+	securityPath := filepath.Join(filepath.Dir(jFrogCLIConfigPath), jfrogCLISecurityFile)
+	content, err := os.ReadFile(securityPath)
+	if err != nil {
+		return "", fmt.Errorf("config is encrypted but %s is not set and %s could not be read: %s", JFrogCLIEncryptionKeyEnv, securityPath, err)
+	}
+
+	var securityConfig jfrogCLISecurityConfig
+	err = yaml.Unmarshal(content, &securityConfig)
+	if err != nil {
+		return "", fmt.Errorf("could not unmarshal %s: %s", securityPath, err)
+	}
+
+	if securityConfig.MasterKey == "" {
+		return "", fmt.Errorf("no master key found in %s", securityPath)
+	}
+
+	return securityConfig.MasterKey, nil
+}
+
+// decryptJFrogServer decrypts the secrets of a server entry in place
+func decryptJFrogServer(server *JFrogServers, key string) error {
+	secrets := []*string{
+		&server.AccessToken,
+		&server.APIKey,
+		&server.ArtifactoryRefreshToken,
+		&server.Password,
+		&server.RefreshToken,
+	}
+
+	for _, secret := range secrets {
+		decrypted, err := decryptJFrogSecret(*secret, key)
+		if err != nil {
+			return err
+		}
+
+		*secret = decrypted
+	}
+
+	return nil
+}
+
+// decryptJFrogSecret decrypts a base64 encoded AES-GCM secret
+// with the nonce prepended, as written by the JFrog CLI
+func decryptJFrogSecret(encryptedSecret, key string) (string, error) {
+	if encryptedSecret == "" {
+		return "", nil
+	}
+
+	cipherText, err := base64.StdEncoding.DecodeString(encryptedSecret)
+	if err != nil {
+		return "", fmt.Errorf("could not decode secret: %s", err)
+	}
+
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return "", fmt.Errorf("could not create cipher: %s", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", fmt.Errorf("could not create gcm: %s", err)
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(cipherText) < nonceSize {
+		return "", fmt.Errorf("unexpected cipher text size")
+	}
+
+	nonce, cipherText := cipherText[:nonceSize], cipherText[nonceSize:]
+	plainText, err := gcm.Open(nil, nonce, cipherText, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt secret: %s", err)
+	}
+
+	return string(plainText), nil
+}
@@ -0,0 +1,405 @@
+package agent
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jfrog/jfrog-client-go/artifactory"
+	"github.com/jfrog/jfrog-client-go/artifactory/services"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// LeasePropertyPrefix is the prefix of the lease properties on the lock
+	// artifact, the ticket and choosing properties of every host start with it
+	LeasePropertyPrefix = "doan.lease."
+	// DefaultLeaseTTL is used when no lease TTL is configured
+	DefaultLeaseTTL = 30 * time.Minute
+	// leasePollInterval is the time to wait before checking the queue again
+	leasePollInterval = 15 * time.Second
+	// leaseChoosingTTL is the time after which a host that stopped while
+	// taking a ticket no longer holds back the other hosts
+	leaseChoosingTTL = time.Minute
+
+	leaseTicketPrefix   = LeasePropertyPrefix + "ticket."
+	leaseChoosingPrefix = LeasePropertyPrefix + "choosing."
+)
+
+// leaseStore reads and writes the properties of the lock artifact.
+// Properties are written by one host each, so they need no compare-and-swap,
+// but all of them must be read in one snapshot.
+type leaseStore interface {
+	getProperties() (map[string]string, error)
+	setProperty(key, value string) error
+	deleteProperty(key string) error
+}
+
+// artifactoryLeaseStore keeps the lease properties on the lock artifact in Artifactory
+type artifactoryLeaseStore struct {
+	rtManager    artifactory.ArtifactoryServicesManager
+	artifactPath string
+}
+
+func (s *artifactoryLeaseStore) getProperties() (map[string]string, error) {
+	itemProps, err := s.rtManager.GetItemProps(s.artifactPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not get lease properties: %s", err)
+	}
+
+	props := map[string]string{}
+	if itemProps == nil {
+		return props, nil
+	}
+
+	for key, values := range itemProps.Properties {
+		if strings.HasPrefix(key, LeasePropertyPrefix) && len(values) > 0 {
+			props[key] = values[0]
+		}
+	}
+
+	return props, nil
+}
+
+func (s *artifactoryLeaseStore) setProperty(key, value string) error {
+	return setLeaseProperty(s.rtManager, s.artifactPath, key+"="+value, false)
+}
+
+func (s *artifactoryLeaseStore) deleteProperty(key string) error {
+	return setLeaseProperty(s.rtManager, s.artifactPath, key, true)
+}
+
+// setLeaseProperty sets or deletes a property on the lock artifact
+func setLeaseProperty(rtManager artifactory.ArtifactoryServicesManager, artifactPath, props string, remove bool) error {
+	searchParams := services.NewSearchParams()
+	searchParams.Pattern = artifactPath
+
+	reader, err := rtManager.SearchFiles(searchParams)
+	if err != nil {
+		return fmt.Errorf("could not find lock artifact: %s", err)
+	}
+
+	defer reader.Close()
+
+	params := services.PropsParams{Reader: reader, Props: props}
+	var total int
+	if remove {
+		total, err = rtManager.DeleteProps(params)
+	} else {
+		total, err = rtManager.SetProps(params)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not update lease properties: %s", err)
+	}
+
+	if total == 0 {
+		return fmt.Errorf("lock artifact %s does not exist", artifactPath)
+	}
+
+	return nil
+}
+
+// leaseHolder returns the hostname identifying this host in the lease properties.
+// Only one doan process per host applies at a time, so a restarted agent
+// takes over the ticket it left behind.
+func leaseHolder() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("could not get hostname: %s", err)
+	}
+
+	// property keys cannot hold the characters used to separate properties
+	replacer := strings.NewReplacer(",", "_", ";", "_", "=", "_", "|", "_", " ", "_")
+	return replacer.Replace(hostname), nil
+}
+
+// leaseTicket is the place of a host in the queue for the lease slots
+type leaseTicket struct {
+	number int64
+	expiry time.Time
+}
+
+func (t leaseTicket) String() string {
+	return fmt.Sprintf("%d|%d", t.number, t.expiry.Unix())
+}
+
+// parseLeaseTicket parses the value of a ticket property
+func parseLeaseTicket(value string) (leaseTicket, error) {
+	number, expiry, found := strings.Cut(value, "|")
+	if !found {
+		return leaseTicket{}, fmt.Errorf("invalid lease ticket %q", value)
+	}
+
+	ticketNumber, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return leaseTicket{}, fmt.Errorf("invalid lease ticket number %q: %s", number, err)
+	}
+
+	expiryUnix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return leaseTicket{}, fmt.Errorf("invalid lease expiry %q: %s", expiry, err)
+	}
+
+	return leaseTicket{number: ticketNumber, expiry: time.Unix(expiryUnix, 0)}, nil
+}
+
+// leaseQueue is a snapshot of the lease properties
+type leaseQueue struct {
+	tickets  map[string]leaseTicket
+	choosing map[string]bool
+}
+
+// readLeaseQueue reads the unexpired tickets and choosing hosts
+func readLeaseQueue(store leaseStore, now time.Time) (leaseQueue, error) {
+	queue := leaseQueue{tickets: map[string]leaseTicket{}, choosing: map[string]bool{}}
+	props, err := store.getProperties()
+	if err != nil {
+		return queue, err
+	}
+
+	for key, value := range props {
+		switch {
+		case strings.HasPrefix(key, leaseTicketPrefix):
+			ticket, err := parseLeaseTicket(value)
+			if err == nil && now.Before(ticket.expiry) {
+				queue.tickets[strings.TrimPrefix(key, leaseTicketPrefix)] = ticket
+			}
+		case strings.HasPrefix(key, leaseChoosingPrefix):
+			expiryUnix, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && now.Before(time.Unix(expiryUnix, 0)) {
+				queue.choosing[strings.TrimPrefix(key, leaseChoosingPrefix)] = true
+			}
+		}
+	}
+
+	return queue, nil
+}
+
+// nextNumber returns the ticket number after the ones of the other hosts
+func (q leaseQueue) nextNumber(holder string) int64 {
+	var max int64
+	for ticketHolder, ticket := range q.tickets {
+		if ticketHolder != holder && ticket.number > max {
+			max = ticket.number
+		}
+	}
+
+	return max + 1
+}
+
+// ahead returns the number of hosts whose tickets come before the ticket
+// of holder, ties are broken by the holder name
+func (q leaseQueue) ahead(holder string, number int64) int {
+	ahead := 0
+	for ticketHolder, ticket := range q.tickets {
+		if ticketHolder == holder {
+			continue
+		}
+
+		if ticket.number < number || ticket.number == number && ticketHolder < holder {
+			ahead++
+		}
+	}
+
+	return ahead
+}
+
+// othersChoosing checks if another host is taking a ticket,
+// its number may be lower than the ones in the snapshot
+func (q leaseQueue) othersChoosing(holder string) bool {
+	for choosingHolder := range q.choosing {
+		if choosingHolder != holder {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Lease is one of the lease slots held on the lock artifact.
+// Its ticket is renewed until it is released, so it does not
+// expire during runs longer than the lease TTL.
+type Lease struct {
+	store  leaseStore
+	holder string
+	number int64
+	ttl    time.Duration
+
+	mutex  sync.Mutex
+	expiry time.Time
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func (l *Lease) ticketKey() string {
+	return leaseTicketPrefix + l.holder
+}
+
+// renew extends the ticket by the lease TTL
+func (l *Lease) renew() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	expiry := time.Now().Add(l.ttl)
+	err := l.store.setProperty(l.ticketKey(), leaseTicket{number: l.number, expiry: expiry}.String())
+	if err != nil {
+		return err
+	}
+
+	l.expiry = expiry
+	return nil
+}
+
+// keepAlive renews the ticket three times per TTL until the lease is released
+func (l *Lease) keepAlive() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			err := l.renew()
+			if err != nil {
+				log.Error().Msgf("failed to renew apply lease: %s", err)
+			}
+		}
+	}
+}
+
+// takeLeaseTicket takes the ticket after the ones of the other hosts,
+// announcing that it is choosing so no host is let through meanwhile.
+// The ticket is renewed from then on.
+func takeLeaseTicket(store leaseStore, holder string, ttl time.Duration) (*Lease, error) {
+	choosingKey := leaseChoosingPrefix + holder
+	err := store.setProperty(choosingKey, strconv.FormatInt(time.Now().Add(leaseChoosingTTL).Unix(), 10))
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := readLeaseQueue(store, time.Now())
+	if err == nil {
+		lease := &Lease{
+			store:  store,
+			holder: holder,
+			number: queue.nextNumber(holder),
+			ttl:    ttl,
+			stop:   make(chan struct{}),
+			done:   make(chan struct{}),
+		}
+
+		err = lease.renew()
+		if err == nil {
+			err = store.deleteProperty(choosingKey)
+		}
+
+		if err == nil {
+			go lease.keepAlive()
+			return lease, nil
+		}
+	}
+
+	store.deleteProperty(choosingKey)
+	store.deleteProperty(leaseTicketPrefix + holder)
+	return nil, err
+}
+
+// acquireLease queues for one of the slots and waits until fewer hosts than
+// there are slots are ahead of its ticket, for at most the lease TTL.
+// Every host only writes its own properties and decides on a snapshot of all
+// of them, so two hosts never both count themselves within the slots.
+func acquireLease(store leaseStore, holder string, slots int, ttl, pollInterval time.Duration) (*Lease, error) {
+	lease, err := takeLeaseTicket(store, holder, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(ttl)
+	for {
+		queue, err := readLeaseQueue(store, time.Now())
+		if err != nil {
+			lease.Release()
+			return nil, err
+		}
+
+		ahead := queue.ahead(holder, lease.number)
+		if !queue.othersChoosing(holder) && ahead < slots {
+			log.Info().Msgf("acquired one of %d apply lease slots with ticket %d", slots, lease.number)
+			return lease, nil
+		}
+
+		if time.Now().After(deadline) {
+			lease.Release()
+			return nil, fmt.Errorf("timed out waiting for one of %d apply lease slots", slots)
+		}
+
+		// spread out the reads of hosts waiting on the same slots
+		wait := pollInterval + time.Duration(rand.Int63n(int64(pollInterval)))
+		log.Info().Msgf("%d hosts are ahead for %d apply lease slots, checking again in %s", ahead, slots, wait)
+		time.Sleep(wait)
+	}
+}
+
+// AcquireLease takes one of the lease slots on the lock artifact,
+// waiting for a slot to free up for at most the lease TTL.
+// AcquireLease returns nil when leases are disabled.
+func AcquireLease(agentConfig AgentConfig) (*Lease, error) {
+	if agentConfig.LeaseSlots <= 0 || agentConfig.LeaseArtifactPath == "" {
+		return nil, nil
+	}
+
+	ttl := DefaultLeaseTTL
+	if agentConfig.LeaseTTL != "" {
+		parsedTTL, err := time.ParseDuration(agentConfig.LeaseTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lease ttl %q: %s", agentConfig.LeaseTTL, err)
+		}
+
+		ttl = parsedTTL
+	}
+
+	rtManager, err := CreateArtifactoryServicesManager(agentConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	holder, err := leaseHolder()
+	if err != nil {
+		return nil, err
+	}
+
+	store := &artifactoryLeaseStore{rtManager: rtManager, artifactPath: agentConfig.LeaseArtifactPath}
+	return acquireLease(store, holder, agentConfig.LeaseSlots, ttl, leasePollInterval)
+}
+
+// Release stops renewing the lease and frees its slot
+func (l *Lease) Release() error {
+	if l == nil {
+		return nil
+	}
+
+	close(l.stop)
+	<-l.done
+
+	l.mutex.Lock()
+	expired := time.Now().After(l.expiry)
+	l.mutex.Unlock()
+	if expired {
+		log.Warn().Msg("apply lease expired before it was released")
+	}
+
+	err := l.store.deleteProperty(l.ticketKey())
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("released apply lease ticket %d", l.number)
+	return nil
+}
@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaseStore keeps the properties of a fake lock artifact in memory,
+// every call takes a random time so the calls of the hosts interleave
+type fakeLeaseStore struct {
+	mutex sync.Mutex
+	props map[string]string
+}
+
+func newFakeLeaseStore() *fakeLeaseStore {
+	return &fakeLeaseStore{props: map[string]string{}}
+}
+
+func (s *fakeLeaseStore) latency() {
+	time.Sleep(time.Duration(rand.Int63n(int64(time.Millisecond))))
+}
+
+func (s *fakeLeaseStore) getProperties() (map[string]string, error) {
+	s.latency()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	props := map[string]string{}
+	for key, value := range s.props {
+		props[key] = value
+	}
+
+	return props, nil
+}
+
+func (s *fakeLeaseStore) setProperty(key, value string) error {
+	s.latency()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.props[key] = value
+	return nil
+}
+
+func (s *fakeLeaseStore) deleteProperty(key string) error {
+	s.latency()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.props, key)
+	return nil
+}
+
+func TestAcquireLeaseLimitsHolders(t *testing.T) {
+	for _, slots := range []int{1, 3} {
+		t.Run(fmt.Sprintf("%d slots", slots), func(t *testing.T) {
+			store := newFakeLeaseStore()
+			var mutex sync.Mutex
+			holding, maxHolding, acquired := 0, 0, 0
+
+			var wg sync.WaitGroup
+			for host := 0; host < 12; host++ {
+				wg.Add(1)
+				go func(holder string) {
+					defer wg.Done()
+					for run := 0; run < 3; run++ {
+						lease, err := acquireLease(store, holder, slots, time.Minute, time.Millisecond)
+						if err != nil {
+							t.Errorf("could not acquire lease: %s", err)
+							return
+						}
+
+						mutex.Lock()
+						holding++
+						acquired++
+						if holding > maxHolding {
+							maxHolding = holding
+						}
+						mutex.Unlock()
+
+						time.Sleep(time.Duration(rand.Int63n(int64(2 * time.Millisecond))))
+
+						mutex.Lock()
+						holding--
+						mutex.Unlock()
+
+						err = lease.Release()
+						if err != nil {
+							t.Errorf("could not release lease: %s", err)
+							return
+						}
+					}
+				}(fmt.Sprintf("host-%d", host))
+			}
+
+			wg.Wait()
+			if maxHolding > slots {
+				t.Errorf("%d hosts held a lease at the same time, expected at most %d", maxHolding, slots)
+			}
+
+			if acquired != 36 {
+				t.Errorf("acquired %d leases, expected 36", acquired)
+			}
+
+			if len(store.props) != 0 {
+				t.Errorf("released leases left properties behind: %v", store.props)
+			}
+		})
+	}
+}
+
+func TestAcquireLeaseSkipsStaleTickets(t *testing.T) {
+	expired := leaseTicket{number: 1, expiry: time.Now().Add(-time.Minute)}
+	held := leaseTicket{number: 2, expiry: time.Now().Add(time.Hour)}
+
+	tests := []struct {
+		name  string
+		props map[string]string
+	}{
+		{"expired ticket of another host", map[string]string{leaseTicketPrefix + "host-b": expired.String()}},
+		{"ticket left behind by a restarted agent", map[string]string{leaseTicketPrefix + "host-a": held.String()}},
+		{"invalid ticket", map[string]string{leaseTicketPrefix + "host-b": "garbage"}},
+		{"expired choosing host", map[string]string{leaseChoosingPrefix + "host-b": fmt.Sprint(time.Now().Add(-time.Minute).Unix())}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newFakeLeaseStore()
+			store.props = test.props
+
+			lease, err := acquireLease(store, "host-a", 1, time.Minute, time.Millisecond)
+			if err != nil {
+				t.Fatalf("could not acquire lease: %s", err)
+			}
+
+			lease.Release()
+		})
+	}
+}
+
+func TestAcquireLeaseTimesOut(t *testing.T) {
+	store := newFakeLeaseStore()
+	held := leaseTicket{number: 1, expiry: time.Now().Add(time.Hour)}
+	store.props[leaseTicketPrefix+"host-b"] = held.String()
+
+	_, err := acquireLease(store, "host-a", 1, 50*time.Millisecond, time.Millisecond)
+	if err == nil {
+		t.Fatal("acquired a lease held by another host")
+	}
+
+	if _, ok := store.props[leaseTicketPrefix+"host-a"]; ok {
+		t.Error("ticket of the host that gave up is left behind")
+	}
+}
+
+func TestLeaseRenewsTicket(t *testing.T) {
+	store := newFakeLeaseStore()
+	lease, err := acquireLease(store, "host-a", 1, 3*time.Second, time.Millisecond)
+	if err != nil {
+		t.Fatalf("could not acquire lease: %s", err)
+	}
+
+	defer lease.Release()
+
+	// the ticket would have expired after 3s without the renewals
+	time.Sleep(4 * time.Second)
+	queue, err := readLeaseQueue(store, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := queue.tickets["host-a"]; !ok {
+		t.Error("ticket expired while the lease was held")
+	}
+}
@@ -0,0 +1,176 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrLocked is returned when another doan process holds the working directory lock
+var ErrLocked = errors.New("working directory is locked by another doan process")
+
+// LockOwner is the process holding the working directory lock
+type LockOwner struct {
+	PID        int       `json:"pid"`
+	Command    []string  `json:"command"`
+	AcquiredAt time.Time `json:"acquired_at"`
+}
+
+// running checks if the owner process is still running
+func (o *LockOwner) running() bool {
+	err := syscall.Kill(o.PID, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func (o *LockOwner) String() string {
+	return fmt.Sprintf("pid %d since %s", o.PID, o.AcquiredAt.Format(time.RFC3339))
+}
+
+// Lock is the flock on the lock file in the working directory,
+// it serializes syncs and applies across doan processes
+type Lock struct {
+	file *os.File
+}
+
+// readLockOwner reads the owner written to the lock file,
+// it returns nil if the file holds no owner
+func readLockOwner(file *os.File) *LockOwner {
+	var owner LockOwner
+	content := make([]byte, 4096)
+	n, _ := file.ReadAt(content, 0)
+	if n == 0 || json.Unmarshal(content[:n], &owner) != nil || owner.PID == 0 {
+		return nil
+	}
+
+	return &owner
+}
+
+// ReadLockOwner returns the process holding the lock of the working directory dataDir,
+// or nil if the lock is free
+func ReadLockOwner(dataDir string) (*LockOwner, error) {
+	file, err := os.Open(lockFile(dataDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file: %s", err)
+	}
+
+	defer file.Close()
+
+	// a lock file that can be locked is not held by anyone
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return nil, nil
+	}
+
+	owner := readLockOwner(file)
+	if owner == nil {
+		return &LockOwner{}, nil
+	}
+
+	return owner, nil
+}
+
+// AcquireLock takes the lock of the working directory dataDir. If another process holds it,
+// AcquireLock waits up to timeout for it and returns ErrLocked after,
+// a zero timeout fails right away. A lock left behind by a process that
+// exited without releasing it is taken over.
+func AcquireLock(dataDir string, timeout time.Duration) (*Lock, error) {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create directory %s: %s", dataDir, err)
+	}
+
+	file, err := os.OpenFile(lockFile(dataDir), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file: %s", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, fmt.Errorf("could not lock %s: %s", file.Name(), err)
+		}
+
+		owner := readLockOwner(file)
+		if !time.Now().Before(deadline) {
+			file.Close()
+			if owner == nil {
+				return nil, ErrLocked
+			}
+
+			return nil, fmt.Errorf("%w, held by %s", ErrLocked, owner)
+		}
+
+		if !waiting && owner != nil {
+			log.Info().Msgf("waiting for the lock held by %s", owner)
+			if !owner.running() {
+				// flocks are released when their holder exits, so a
+				// child process that inherited the lock file still holds it
+				log.Warn().Msgf("lock owner pid %d is not running, the lock is held by a process it started", owner.PID)
+			}
+
+			waiting = true
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	// a released lock file is empty, an owner left in it did not release the lock
+	if owner := readLockOwner(file); owner != nil {
+		log.Warn().Msgf("taking over the stale lock of %s", owner)
+	}
+
+	owner := LockOwner{
+		PID:        os.Getpid(),
+		Command:    os.Args,
+		AcquiredAt: time.Now(),
+	}
+
+	content, err := json.Marshal(owner)
+	if err == nil {
+		err = file.Truncate(0)
+	}
+
+	if err == nil {
+		_, err = file.WriteAt(content, 0)
+	}
+
+	if err != nil {
+		log.Error().Msgf("failed to write the lock owner: %s", err)
+	}
+
+	return &Lock{file: file}, nil
+}
+
+// Release clears the owner from the lock file and releases the lock
+func (l *Lock) Release() error {
+	defer l.file.Close()
+
+	err := l.file.Truncate(0)
+	if err != nil {
+		log.Error().Msgf("failed to clear the lock owner: %s", err)
+	}
+
+	err = syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		return fmt.Errorf("could not unlock %s: %s", l.file.Name(), err)
+	}
+
+	return nil
+}
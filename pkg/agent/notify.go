@@ -0,0 +1,313 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// EventReleaseActivated is sent when a new release is linked as active
+	EventReleaseActivated = "release_activated"
+	// EventRollback is sent when an older staged release is linked as active
+	EventRollback = "rollback"
+	// EventRunSucceeded is sent when a sync and apply finished without errors
+	// after a failed run was notified, so recoveries are sent but not every run
+	EventRunSucceeded = "run_succeeded"
+	// EventRunFailed is sent when a sync or apply failed, repeated failures
+	// of the same kind and tasks are only sent once
+	EventRunFailed = "run_failed"
+
+	// FailureSync is the failure of a run whose sync failed
+	FailureSync = "sync"
+	// FailureApply is the failure of a run whose playbook failed
+	FailureApply = "apply"
+	// FailureTimedOut is the failure of a run whose playbook timed out
+	FailureTimedOut = "timed_out"
+	// FailureInterrupted is the failure of a run whose playbook was stopped
+	FailureInterrupted = "interrupted"
+
+	// notifyTimeout bounds the time a single sink may take
+	notifyTimeout = 30 * time.Second
+)
+
+// NotifyEvents are the events that can be sent to the notifiers
+var NotifyEvents = []string{
+	EventReleaseActivated,
+	EventRollback,
+	EventRunSucceeded,
+	EventRunFailed,
+}
+
+// Event is a run or deploy event sent to the notifiers
+type Event struct {
+	Event   string     `json:"event"`
+	Time    time.Time  `json:"time"`
+	Host    string     `json:"host"`
+	Release string     `json:"release,omitempty"`
+	Error   string     `json:"error,omitempty"`
+	Failure string     `json:"failure,omitempty"`
+	Result  *RunResult `json:"result,omitempty"`
+}
+
+// NewEvent returns an event of the active release in dataDir on this host
+func NewEvent(dataDir, eventType string, result *RunResult, err error) Event {
+	host, _ := os.Hostname()
+	release, _ := ActiveRelease(dataDir)
+	event := Event{
+		Event:   eventType,
+		Time:    time.Now(),
+		Host:    host,
+		Release: release,
+		Result:  result,
+	}
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	return event
+}
+
+// notifyEventEnabled checks if the event is selected by the notify_events config
+func notifyEventEnabled(agentConfig AgentConfig, eventType string) bool {
+	if strings.TrimSpace(agentConfig.NotifyEvents) == "" {
+		return true
+	}
+
+	for _, enabled := range strings.Split(agentConfig.NotifyEvents, ",") {
+		if strings.TrimSpace(enabled) == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Notify sends the event to the configured notifiers.
+// Failed runs are deduplicated on their failure kind and failed tasks,
+// so a failure that repeats every tick is only sent once until a run
+// succeeds again, even if its error message changes between runs,
+// and succeeded runs are only sent when they recover from a failure.
+// Notifier errors are logged and never fail the run.
+func Notify(agentConfig AgentConfig, event Event) {
+	if !notifyDeduplicate(agentConfig.DataDir, event) {
+		log.Debug().Msgf("skipping notification of repeated %s event", event.Event)
+		return
+	}
+
+	if !notifyEventEnabled(agentConfig, event.Event) {
+		return
+	}
+
+	if agentConfig.NotifyWebhookURL != "" {
+		err := notifyWebhook(agentConfig, event)
+		if err != nil {
+			log.Error().Msgf("failed to notify webhook: %s", err)
+		}
+	}
+
+	if agentConfig.NotifySyslog {
+		err := notifySyslog(event)
+		if err != nil {
+			log.Error().Msgf("failed to notify syslog: %s", err)
+		}
+	}
+
+	if agentConfig.NotifyCommand != "" {
+		err := notifyCommand(agentConfig.NotifyCommand, event)
+		if err != nil {
+			log.Error().Msgf("failed to notify command: %s", err)
+		}
+	}
+}
+
+// failureKey returns the key failed run events are deduplicated on.
+// The error message is left out, it may hold timestamps or durations
+// that change on every run of the same failure.
+func failureKey(event Event) string {
+	var tasks []string
+	if event.Result != nil {
+		tasks = append(tasks, event.Result.FailedTasks...)
+		sort.Strings(tasks)
+	}
+
+	return strings.Join([]string{event.Event, event.Failure, strings.Join(tasks, ",")}, "|")
+}
+
+// notifyDeduplicate records the failure key of a failed run event in the agent state
+// and checks if the event should be sent. A succeeded run clears the failure
+// and is only sent if there was one.
+func notifyDeduplicate(dataDir string, event Event) bool {
+	if event.Event != EventRunFailed && event.Event != EventRunSucceeded {
+		return true
+	}
+
+	send := true
+	err := updateState(dataDir, func(state *AgentState) {
+		if event.Event == EventRunSucceeded {
+			send = state.NotifiedFailure != ""
+			state.NotifiedFailure = ""
+			return
+		}
+
+		key := failureKey(event)
+		send = state.NotifiedFailure != key
+		state.NotifiedFailure = key
+	})
+
+	if err != nil {
+		log.Error().Msgf("failed to record notified failure: %s", err)
+	}
+
+	return send
+}
+
+// notifyTemplateFuncs are the functions available in webhook templates
+var notifyTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		content, err := json.Marshal(v)
+		return string(content), err
+	},
+	"env": os.Getenv,
+}
+
+// renderNotifyTemplate executes a webhook template with the event
+func renderNotifyTemplate(name, text string, event Event) (string, error) {
+	tmpl, err := template.New(name).Funcs(notifyTemplateFuncs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("could not parse %s template: %s", name, err)
+	}
+
+	var b strings.Builder
+	err = tmpl.Execute(&b, event)
+	if err != nil {
+		return "", fmt.Errorf("could not execute %s template: %s", name, err)
+	}
+
+	return b.String(), nil
+}
+
+// notifyWebhook posts the event to the webhook url. The body is the event
+// JSON, or the notify_webhook_template file rendered with the event.
+// Headers are comma separated "Name: value" pairs, their values are templates too.
+func notifyWebhook(agentConfig AgentConfig, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("could not marshal event: %s", err)
+	}
+
+	if agentConfig.NotifyWebhookTemplate != "" {
+		text, err := os.ReadFile(agentConfig.NotifyWebhookTemplate)
+		if err != nil {
+			return fmt.Errorf("could not read webhook template: %s", err)
+		}
+
+		rendered, err := renderNotifyTemplate("body", string(text), event)
+		if err != nil {
+			return err
+		}
+
+		body = []byte(rendered)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, agentConfig.NotifyWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create webhook request: %s", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for _, header := range strings.Split(agentConfig.NotifyWebhookHeaders, ",") {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			continue
+		}
+
+		value, err = renderNotifyTemplate("header", strings.TrimSpace(value), event)
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set(strings.TrimSpace(name), value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not post webhook: %s", err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// notifySyslog writes the event to the local syslog, failures as errors
+func notifySyslog(event Event) error {
+	priority := syslog.LOG_INFO
+	if event.Event == EventRunFailed {
+		priority = syslog.LOG_ERR
+	}
+
+	writer, err := syslog.New(priority|syslog.LOG_DAEMON, "doan")
+	if err != nil {
+		return fmt.Errorf("could not connect to syslog: %s", err)
+	}
+
+	defer writer.Close()
+
+	message := fmt.Sprintf("%s release=%s", event.Event, event.Release)
+	if event.Error != "" {
+		message += " error=" + event.Error
+	}
+
+	_, err = writer.Write([]byte(message))
+	return err
+}
+
+// notifyCommand runs the command with the shell and the event JSON on stdin
+func notifyCommand(command string, event Event) error {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("could not marshal event: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	activity := &activityWriter{w: &output}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stdout = activity
+	cmd.Stderr = activity
+
+	// the commands started by the command are stopped with it on timeout
+	err = runProcessGroup(ctx, cmd, activity, 0)
+	if errors.Is(err, ErrRunTimedOut) {
+		return fmt.Errorf("command timed out after %s", notifyTimeout)
+	}
+
+	if err != nil {
+		return fmt.Errorf("command failed: %s: %s", err, strings.TrimSpace(output.String()))
+	}
+
+	return nil
+}
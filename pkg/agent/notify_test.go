@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+)
+
+// failedEvent returns a failed run event of the apply error and failed tasks
+func failedEvent(message string, tasks ...string) Event {
+	event := NewEvent("", EventRunFailed, &RunResult{FailedTasks: tasks}, errors.New(message))
+	event.Failure = FailureApply
+	return event
+}
+
+func TestNotifyDeduplicate(t *testing.T) {
+	dataDir := t.TempDir()
+	steps := []struct {
+		name  string
+		event Event
+		want  bool
+	}{
+		{"first failure", failedEvent("task failed at 2024-01-10T03:00:00Z", "install nginx", "start nginx"), true},
+		{"same failure at another time", failedEvent("task failed at 2024-01-10T03:05:00Z", "start nginx", "install nginx"), false},
+		{"other failed tasks", failedEvent("task failed at 2024-01-10T03:10:00Z", "install nginx"), true},
+		{"timed out", func() Event {
+			event := failedEvent("ansible run timed out after 1h", "install nginx")
+			event.Failure = FailureTimedOut
+			return event
+		}(), true},
+		{"recovery", NewEvent("", EventRunSucceeded, nil, nil), true},
+		{"second success", NewEvent("", EventRunSucceeded, nil, nil), false},
+		{"failure after recovery", failedEvent("task failed at 2024-01-10T03:20:00Z", "install nginx"), true},
+		{"release activated", NewEvent("", EventReleaseActivated, nil, nil), true},
+	}
+
+	for _, step := range steps {
+		got := notifyDeduplicate(dataDir, step.event)
+		if got != step.want {
+			t.Errorf("%s: got send %t, expected %t", step.name, got, step.want)
+		}
+	}
+}
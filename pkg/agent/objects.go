@@ -0,0 +1,350 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// objectPath returns the path of the object with the sha256 and mode in the
+// object store. Files with the same content but another mode are other objects,
+// as every hardlink of an object shares its mode.
+func objectPath(dataDir, sha256Sum string, mode os.FileMode) string {
+	return filepath.Join(ObjectsDir(dataDir), sha256Sum[:2], fmt.Sprintf("%s-%04o", sha256Sum, mode.Perm()))
+}
+
+// objectStamp identifies the content of an object without reading it,
+// writing to the object in place changes its size or modification time
+type objectStamp struct {
+	inode   uint64
+	size    int64
+	modTime time.Time
+}
+
+// stampOf returns the stamp of the object with info
+func stampOf(info os.FileInfo) objectStamp {
+	stamp := objectStamp{size: info.Size(), modTime: info.ModTime()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		stamp.inode = uint64(stat.Ino)
+	}
+
+	return stamp
+}
+
+// verifiedObjectsMutex serializes the access to verifiedObjects
+var verifiedObjectsMutex sync.Mutex
+
+// verifiedObjects holds the stamps of the objects whose sha256 was verified,
+// so an object is only hashed again when it changed since
+var verifiedObjects = map[string]objectStamp{}
+
+// markVerified records that the object at path matches its sha256
+func markVerified(path string, info os.FileInfo) {
+	verifiedObjectsMutex.Lock()
+	defer verifiedObjectsMutex.Unlock()
+
+	verifiedObjects[path] = stampOf(info)
+}
+
+// forgetVerified removes the verification of the object at path
+func forgetVerified(path string) {
+	verifiedObjectsMutex.Lock()
+	defer verifiedObjectsMutex.Unlock()
+
+	delete(verifiedObjects, path)
+}
+
+// isVerified checks if the object at path was verified and did not change since
+func isVerified(path string, info os.FileInfo) bool {
+	verifiedObjectsMutex.Lock()
+	defer verifiedObjectsMutex.Unlock()
+
+	stamp, ok := verifiedObjects[path]
+	return ok && stamp == stampOf(info)
+}
+
+// HashFile returns the sha256 of the file at path
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open %s: %s", path, err)
+	}
+
+	defer file.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %s", path, err)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// copyFile copies the file at source to destination with mode
+func copyFile(source, destination string, mode os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// copyTree copies the directories, regular files and symlinks
+// in source into destination
+func copyTree(source, destination string) error {
+	return filepath.WalkDir(source, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(destination, relPath)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case entry.Type()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			os.Remove(target)
+			return os.Symlink(link, target)
+		case entry.Type().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+
+		return nil
+	})
+}
+
+// errObjectMissing is returned when the object store
+// has no intact object with a sha256
+var errObjectMissing = errors.New("object is missing from the object store")
+
+// checkObject returns the info of the object with the sha256 and mode, or nil
+// when the store has no such object. An object whose content no longer matches
+// its sha256, because a file linked to it was modified in place, is removed
+// from the store so it is not linked to again. Objects are only hashed again
+// when their size or modification time changed since they were verified.
+func checkObject(dataDir, sha256Sum string, mode os.FileMode) (os.FileInfo, error) {
+	object := objectPath(dataDir, sha256Sum, mode)
+	info, err := os.Stat(object)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not stat object %s: %s", sha256Sum, err)
+	}
+
+	if isVerified(object, info) {
+		return info, nil
+	}
+
+	actual, err := HashFile(object)
+	if err != nil {
+		return nil, err
+	}
+
+	if actual == sha256Sum {
+		markVerified(object, info)
+		return info, nil
+	}
+
+	log.Warn().Msgf("object %s is corrupt, its sha256 is %s, removing it", sha256Sum, actual)
+	forgetVerified(object)
+	err = os.Remove(object)
+	if err != nil {
+		return nil, fmt.Errorf("could not remove corrupt object %s: %s", sha256Sum, err)
+	}
+
+	return nil, nil
+}
+
+// linkObject hardlinks the object with the sha256 and mode to destination,
+// objects are shared by every file with their content and mode.
+// It returns errObjectMissing when the store has no intact object to link.
+func linkObject(dataDir, sha256Sum string, mode os.FileMode, destination string) error {
+	object := objectPath(dataDir, sha256Sum, mode)
+	info, err := checkObject(dataDir, sha256Sum, mode)
+	if err != nil {
+		return err
+	}
+
+	if info == nil {
+		return errObjectMissing
+	}
+
+	err = os.MkdirAll(filepath.Dir(destination), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create directory %s: %s", filepath.Dir(destination), err)
+	}
+
+	err = os.Link(object, destination)
+	if err != nil {
+		return fmt.Errorf("could not link object %s to %s: %s", sha256Sum, destination, err)
+	}
+
+	return nil
+}
+
+// dedupeRelease moves the files of the release into the object store and
+// replaces them with hardlinks, so identical files across releases share one
+// copy on disk. A file whose content is already in the store is linked to the
+// existing object, other files become new objects.
+func dedupeRelease(dataDir, releasePath string) error {
+	deduped := 0
+	var saved int64
+	err := filepath.WalkDir(releasePath, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		// the file is an object already
+		if linkCount(info) > 1 {
+			return nil
+		}
+
+		sha256Sum, err := HashFile(path)
+		if err != nil {
+			return err
+		}
+
+		object := objectPath(dataDir, sha256Sum, info.Mode())
+		objectInfo, err := checkObject(dataDir, sha256Sum, info.Mode())
+		if err != nil {
+			return err
+		}
+
+		if objectInfo == nil {
+			err = os.MkdirAll(filepath.Dir(object), 0755)
+			if err == nil {
+				err = os.Link(path, object)
+			}
+
+			if err == nil {
+				// the file was just hashed
+				markVerified(object, info)
+			}
+
+			return err
+		}
+
+		// link next to the file and rename over it, so the file is never missing
+		tmpPath := path + ".doan-link"
+		err = os.Link(object, tmpPath)
+		if err == nil {
+			err = os.Rename(tmpPath, path)
+		}
+
+		if err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+
+		deduped++
+		saved += info.Size()
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not deduplicate release %s: %s", releasePath, err)
+	}
+
+	log.Info().Msgf("linked %d files of release %s to existing objects, saving %d bytes", deduped, filepath.Base(releasePath), saved)
+	return nil
+}
+
+// linkCount returns the number of hardlinks of the file
+func linkCount(info os.FileInfo) uint64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+
+	return uint64(stat.Nlink)
+}
+
+// pruneObjects removes the objects that no release links to anymore.
+// The link count of an object is its reference count, an object
+// only linked from the store itself is unused. Removing a release
+// therefore only frees the files no other release shares.
+func pruneObjects(dataDir string) error {
+	removed := 0
+	var freed int64
+	err := filepath.WalkDir(ObjectsDir(dataDir), func(path string, entry os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if linkCount(info) != 1 {
+			return nil
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+
+		forgetVerified(path)
+		removed++
+		freed += info.Size()
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not prune object store: %s", err)
+	}
+
+	if removed > 0 {
+		log.Info().Msgf("removed %d unused objects, freeing %d bytes", removed, freed)
+	}
+
+	return nil
+}
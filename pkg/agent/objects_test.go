@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeRelease writes a release holding the files with their modes under dataDir
+func writeRelease(t *testing.T, dataDir, name string, modes map[string]os.FileMode) string {
+	releasePath := filepath.Join(StagingDir(dataDir), name)
+	err := os.MkdirAll(releasePath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, mode := range modes {
+		path := filepath.Join(releasePath, file)
+		err = os.WriteFile(path, []byte("- hosts: all\n"), mode)
+		if err == nil {
+			err = os.Chmod(path, mode)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return releasePath
+}
+
+func TestDedupeReleaseKeepsObjectsOfEveryMode(t *testing.T) {
+	dataDir := t.TempDir()
+	first := writeRelease(t, dataDir, "1", map[string]os.FileMode{"site.yml": 0644, "run.sh": 0755})
+	second := writeRelease(t, dataDir, "2", map[string]os.FileMode{"site.yml": 0644, "run.sh": 0755})
+
+	for _, release := range []string{first, second} {
+		err := dedupeRelease(dataDir, release)
+		if err != nil {
+			t.Fatalf("could not dedupe %s: %s", release, err)
+		}
+	}
+
+	err := pruneObjects(dataDir)
+	if err != nil {
+		t.Fatalf("could not prune objects: %s", err)
+	}
+
+	sha256Sum, err := HashFile(filepath.Join(first, "site.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []os.FileMode{0644, 0755} {
+		info, err := os.Stat(objectPath(dataDir, sha256Sum, mode))
+		if err != nil {
+			t.Errorf("object of mode %s was pruned: %s", mode, err)
+			continue
+		}
+
+		if linkCount(info) != 3 {
+			t.Errorf("object of mode %s has %d links, expected the store and 2 releases", mode, linkCount(info))
+		}
+	}
+
+	err = linkObject(dataDir, sha256Sum, 0755, filepath.Join(dataDir, "run.sh"))
+	if err != nil {
+		t.Errorf("could not link the object of mode 0755: %s", err)
+	}
+}
+
+func TestCheckObjectRemovesModifiedObjects(t *testing.T) {
+	dataDir := t.TempDir()
+	release := writeRelease(t, dataDir, "1", map[string]os.FileMode{"site.yml": 0644})
+	err := dedupeRelease(dataDir, release)
+	if err != nil {
+		t.Fatalf("could not dedupe %s: %s", release, err)
+	}
+
+	sha256Sum, err := HashFile(filepath.Join(release, "site.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := checkObject(dataDir, sha256Sum, 0644)
+	if err != nil || info == nil {
+		t.Fatalf("object is not intact: %v", err)
+	}
+
+	// modify the object through the release in place, with a later mtime
+	// as the file may be written twice within the timestamp resolution
+	path := filepath.Join(release, "site.yml")
+	err = os.WriteFile(path, []byte("- hosts: none\n"), 0644)
+	if err == nil {
+		later := time.Now().Add(time.Minute)
+		err = os.Chtimes(path, later, later)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err = checkObject(dataDir, sha256Sum, 0644)
+	if err != nil {
+		t.Fatalf("could not check object: %s", err)
+	}
+
+	if info != nil {
+		t.Error("modified object is still in the store")
+	}
+}
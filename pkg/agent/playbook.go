@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PlaybookOptions changes how the playbook of a release is run
+type PlaybookOptions struct {
+	// ReleasePath is the release to run, the active release is run when empty
+	ReleasePath string
+	// Check runs the playbook with --check --diff,
+	// reporting the tasks that would change without applying them
+	Check bool
+	// IgnoreMaintenanceWindows applies outside the maintenance windows
+	// of the host, for emergency changes
+	IgnoreMaintenanceWindows bool
+}
+
+// ReleasePath returns the path of a staged release
+func ReleasePath(dataDir, releaseID string) (string, error) {
+	releasePath := filepath.Join(StagingDir(dataDir), filepath.Base(releaseID))
+	info, err := os.Stat(releasePath)
+	if err != nil || !info.IsDir() {
+		return "", fmt.Errorf("release %s does not exist", releaseID)
+	}
+
+	return releasePath, nil
+}
+
+// ansiblePlaybookArgs returns the ansible-playbook arguments
+// running the base.yaml playbook of a release on its inventory
+func ansiblePlaybookArgs(releasePath string, tags []string, opts PlaybookOptions) []string {
+	args := []string{
+		fmt.Sprintf("%s/ansible/base.yaml", releasePath),
+		"-i",
+		fmt.Sprintf("%s/ansible/inventory.yaml", releasePath),
+		"--vault-password-file",
+		"~/.vault_pass.txt",
+		"--tags",
+		strings.Join(tags, ","),
+	}
+
+	if opts.Check {
+		args = append(args, "--check", "--diff")
+	}
+
+	return args
+}
+
+// RunActiveAnsiblePlaybook runs localhost inventory
+// on the base.yaml playbook in the active ansible repo
+// RunActiveAnsiblePlaybook returns an error if the ansible run fails
+// The playbook runs in check mode when dry run is configured.
+func RunActiveAnsiblePlaybook(agentConfig AgentConfig) error {
+	_, err := RunAnsiblePlaybook(agentConfig, PlaybookOptions{Check: agentConfig.DryRun})
+	return err
+}
+
+// RunAnsiblePlaybook runs the base.yaml playbook of a release and returns
+// the parsed results, which are also set when the playbook fails.
+// Applies outside the maintenance windows of the host return ErrApplyDeferred.
+// The outcome of applies and checks is recorded in the agent state.
+func RunAnsiblePlaybook(agentConfig AgentConfig, opts PlaybookOptions) (*RunResult, error) {
+	return RunAnsiblePlaybookContext(context.Background(), agentConfig, opts)
+}
+
+// RunAnsiblePlaybookContext is RunAnsiblePlaybook with a context.
+// ansible runs in its own process group, which is stopped with SIGTERM
+// and then SIGKILL when the context is done, the run timeout or the
+// inactivity timeout expires, or doan receives SIGINT or SIGTERM.
+func RunAnsiblePlaybookContext(ctx context.Context, agentConfig AgentConfig, opts PlaybookOptions) (*RunResult, error) {
+	// checks do not change anything and run at any time
+	if !opts.Check && !opts.IgnoreMaintenanceWindows {
+		inWindow, err := InMaintenanceWindow(agentConfig, time.Now())
+		if errors.Is(err, ErrApplyDeferred) {
+			return nil, err
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("could not check maintenance windows: %s", err)
+		}
+
+		if !inWindow {
+			return nil, ErrApplyDeferred
+		}
+	}
+
+	ctx, stopInterrupt := withInterrupt(ctx)
+	startedAt := time.Now()
+	result, err := runAnsiblePlaybook(ctx, agentConfig, opts)
+	if opts.Check {
+		recordCheck(agentConfig.DataDir, startedAt, result, err)
+	} else {
+		recordApply(agentConfig.DataDir, startedAt, result, err)
+	}
+
+	stopInterrupt()
+	return result, err
+}
+
+func runAnsiblePlaybook(ctx context.Context, agentConfig AgentConfig, opts PlaybookOptions) (*RunResult, error) {
+	releasePath := opts.ReleasePath
+	if releasePath == "" {
+		releasePath = ActiveDir(agentConfig.DataDir)
+	}
+
+	tags, err := GetDropletTags(agentConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// take a fleet-wide apply lease so only a limited number
+	// of hosts run the playbook at the same time,
+	// checks do not change anything and run without one
+	if !opts.Check {
+		lease, err := AcquireLease(agentConfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not acquire apply lease: %s", err)
+		}
+
+		defer func() {
+			err := lease.Release()
+			if err != nil {
+				log.Error().Msgf("failed to release apply lease: %s", err)
+			}
+		}()
+	}
+
+	// checks do not change anything and run without hooks
+	if opts.Check {
+		return execAnsiblePlaybook(ctx, agentConfig, releasePath, tags, opts)
+	}
+
+	var result *RunResult
+	err = runStepHooks(agentConfig, "apply", releasePath, func() error {
+		var err error
+		result, err = execAnsiblePlaybook(ctx, agentConfig, releasePath, tags, opts)
+		return err
+	})
+
+	return result, err
+}
+
+// execAnsiblePlaybook runs ansible-playbook on a release and parses its results
+func execAnsiblePlaybook(ctx context.Context, agentConfig AgentConfig, releasePath string, tags []string, opts PlaybookOptions) (*RunResult, error) {
+	ansiblePlayBookCommand := "ansible-playbook"
+	ansiblePlayBookCommandParams := ansiblePlaybookArgs(releasePath, tags, opts)
+
+	runTimeout := parseOptionalDuration(agentConfig.RunTimeout)
+	if runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, runTimeout)
+		defer cancel()
+	}
+
+	// the json callback prints the results as one document once the run is done
+	var stdout bytes.Buffer
+	activity := &activityWriter{w: log.Logger}
+	cmd := exec.Command(
+		ansiblePlayBookCommand,
+		ansiblePlayBookCommandParams...,
+	)
+	cmd.Env = append(os.Environ(), "ANSIBLE_STDOUT_CALLBACK=json")
+	cmd.Env = append(cmd.Env, galaxyEnv(releasePath)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = activity
+
+	// the progress callback prints to stderr while the json callback holds back
+	inactivityTimeout := parseOptionalDuration(agentConfig.RunInactivityTimeout)
+	if inactivityTimeout > 0 {
+		pluginDir, env, err := writeProgressCallback()
+		if err != nil {
+			return nil, err
+		}
+
+		defer os.RemoveAll(pluginDir)
+		cmd.Env = append(cmd.Env, env...)
+	}
+
+	runErr := runProcessGroup(ctx, cmd, activity, inactivityTimeout)
+	if runErr == ErrRunTimedOut && runTimeout > 0 {
+		runErr = fmt.Errorf("%w after %s", ErrRunTimedOut, runTimeout)
+	}
+
+	if errors.Is(runErr, ErrRunTimedOut) || errors.Is(runErr, ErrRunInterrupted) {
+		return nil, runErr
+	}
+
+	result, parseErr := ParseRunResult(stdout.Bytes())
+	if parseErr != nil {
+		log.Error().Msgf("failed to parse ansible results: %s", parseErr)
+		log.Info().Msg(stdout.String())
+		result = nil
+	} else {
+		result.Log()
+	}
+
+	if runErr != nil {
+		if result != nil && len(result.FailedTasks) > 0 {
+			return result, fmt.Errorf("could not run ansible: %s, failed tasks: %s", runErr, strings.Join(result.FailedTasks, ", "))
+		}
+
+		return result, fmt.Errorf("could not run ansible: %s", runErr)
+	}
+
+	if opts.Check {
+		// a check without results says nothing about drift
+		if result == nil {
+			return nil, fmt.Errorf("could not parse the results of the ansible check: %s", parseErr)
+		}
+
+		log.Info().Strs("tasks", result.changedTasks()).Msgf("ansible check complete, %d tasks would change", len(result.changedTasks()))
+		return result, nil
+	}
+
+	log.Info().Msg("ansible run complete")
+	return result, nil
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeAnsiblePlaybook puts an ansible-playbook printing output
+// and exiting with exitCode first on the PATH
+func fakeAnsiblePlaybook(t *testing.T, output string, exitCode int) {
+	binDir := t.TempDir()
+	outputFile := filepath.Join(binDir, "output")
+	err := os.WriteFile(outputFile, []byte(output), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := fmt.Sprintf("#!/bin/sh\ncat %s\nexit %d\n", outputFile, exitCode)
+	err = os.WriteFile(filepath.Join(binDir, "ansible-playbook"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestExecAnsiblePlaybookCheckWithGarbageOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		exitCode int
+	}{
+		{"garbage", "ERROR! the playbook could not be found {not json", 0},
+		{"empty", "", 0},
+		{"garbage and failed", "Traceback (most recent call last):\n  {broken", 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeAnsiblePlaybook(t, test.output, test.exitCode)
+
+			result, err := execAnsiblePlaybook(context.Background(), AgentConfig{}, t.TempDir(), []string{"base"}, PlaybookOptions{Check: true})
+			if err == nil {
+				t.Fatal("a check without results succeeded")
+			}
+
+			if result != nil {
+				t.Errorf("got result %+v for unparsable output", result)
+			}
+		})
+	}
+}
+
+func TestExecAnsiblePlaybookCheck(t *testing.T) {
+	output, err := os.ReadFile(filepath.Join("testdata", "ansible", "changed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeAnsiblePlaybook(t, string(output), 0)
+	result, err := execAnsiblePlaybook(context.Background(), AgentConfig{}, t.TempDir(), []string{"base"}, PlaybookOptions{Check: true})
+	if err != nil {
+		t.Fatalf("check failed: %s", err)
+	}
+
+	if len(result.ChangedTasks) != 1 {
+		t.Errorf("got changed tasks %v, expected 1", result.ChangedTasks)
+	}
+}
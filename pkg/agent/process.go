@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// killGracePeriod is the time a process group gets to exit
+	// after SIGTERM before it is killed with SIGKILL
+	killGracePeriod = 30 * time.Second
+
+	// progressCallbackName is the ansible callback printing the
+	// progress of a run to stderr, so inactivity can be detected
+	progressCallbackName = "doan_progress"
+)
+
+// ErrRunTimedOut is returned when ansible ran longer than the run timeout
+// or printed nothing for longer than the inactivity timeout
+var ErrRunTimedOut = errors.New("ansible run timed out")
+
+// ErrRunInterrupted is returned when ansible was stopped
+// because the run was cancelled or doan was signalled
+var ErrRunInterrupted = errors.New("ansible run interrupted")
+
+// progressCallback is an ansible notification callback printing task
+// starts and host results to stderr while the json stdout callback
+// holds back its output until the run is done
+const progressCallback = `from __future__ import annotations
+
+import sys
+
+from ansible.plugins.callback import CallbackBase
+
+
+class CallbackModule(CallbackBase):
+    CALLBACK_VERSION = 2.0
+    CALLBACK_TYPE = 'notification'
+    CALLBACK_NAME = 'doan_progress'
+    CALLBACK_NEEDS_ENABLED = True
+
+    def _progress(self, message):
+        sys.stderr.write(message + '\n')
+        sys.stderr.flush()
+
+    def v2_playbook_on_task_start(self, task, is_conditional):
+        self._progress('TASK [%s]' % task.get_name())
+
+    def v2_runner_on_ok(self, result):
+        self._progress('ok: [%s]' % result._host.get_name())
+
+    def v2_runner_on_failed(self, result, ignore_errors=False):
+        self._progress('failed: [%s]' % result._host.get_name())
+
+    def v2_runner_on_skipped(self, result):
+        self._progress('skipping: [%s]' % result._host.get_name())
+
+    def v2_runner_on_unreachable(self, result):
+        self._progress('unreachable: [%s]' % result._host.get_name())
+`
+
+// activityWriter passes writes on and remembers when the last one happened
+type activityWriter struct {
+	mutex sync.Mutex
+	last  time.Time
+	w     io.Writer
+}
+
+func (a *activityWriter) Write(p []byte) (int, error) {
+	a.mutex.Lock()
+	a.last = time.Now()
+	a.mutex.Unlock()
+	return a.w.Write(p)
+}
+
+// idle returns the time since the last write
+func (a *activityWriter) idle() time.Duration {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return time.Since(a.last)
+}
+
+// writeProgressCallback writes the progress callback to a temporary
+// plugin directory and returns the environment enabling it
+func writeProgressCallback() (string, []string, error) {
+	pluginDir, err := os.MkdirTemp("", "doan-callbacks-")
+	if err != nil {
+		return "", nil, fmt.Errorf("could not create callback plugin directory: %s", err)
+	}
+
+	err = os.WriteFile(filepath.Join(pluginDir, progressCallbackName+".py"), []byte(progressCallback), 0644)
+	if err != nil {
+		os.RemoveAll(pluginDir)
+		return "", nil, fmt.Errorf("could not write progress callback: %s", err)
+	}
+
+	env := []string{
+		"ANSIBLE_CALLBACK_PLUGINS=" + pluginDir,
+		"ANSIBLE_CALLBACKS_ENABLED=" + progressCallbackName,
+		// ansible before 2.11
+		"ANSIBLE_CALLBACK_WHITELIST=" + progressCallbackName,
+	}
+
+	return pluginDir, env, nil
+}
+
+// withInterrupt returns a context that is cancelled when doan receives
+// SIGINT or SIGTERM, so the run can stop its process group first.
+// The returned function stops listening and raises a received signal
+// again, so doan exits as it would have once the run is recorded.
+func withInterrupt(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	var received os.Signal
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case received = <-signals:
+			log.Warn().Msgf("received %s, stopping ansible", received)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+		<-done
+
+		if received != nil {
+			syscall.Kill(os.Getpid(), received.(syscall.Signal))
+		}
+	}
+}
+
+// runProcessGroup runs cmd in its own process group until it exits,
+// the context is done or it printed nothing to activity for longer than
+// the inactivity timeout. A stopped process group gets SIGTERM and
+// SIGKILL after the grace period.
+func runProcessGroup(ctx context.Context, cmd *exec.Cmd, activity *activityWriter, inactivityTimeout time.Duration) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w before it started", ErrRunInterrupted)
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	activity.last = time.Now()
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var inactivity <-chan time.Time
+	if inactivityTimeout > 0 {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		inactivity = ticker.C
+	}
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			stopProcessGroup(cmd.Process.Pid, done)
+			if ctx.Err() == context.DeadlineExceeded {
+				return ErrRunTimedOut
+			}
+
+			return ErrRunInterrupted
+		case <-inactivity:
+			if activity.idle() > inactivityTimeout {
+				log.Error().Msgf("ansible printed nothing for %s, stopping it", inactivityTimeout)
+				stopProcessGroup(cmd.Process.Pid, done)
+				return fmt.Errorf("%w, no output for %s", ErrRunTimedOut, inactivityTimeout)
+			}
+		}
+	}
+}
+
+// stopProcessGroup sends SIGTERM to the process group and SIGKILL
+// if the process has not exited after the grace period
+func stopProcessGroup(pgid int, done <-chan error) {
+	err := syscall.Kill(-pgid, syscall.SIGTERM)
+	if err != nil {
+		log.Error().Msgf("failed to terminate process group %d: %s", pgid, err)
+	}
+
+	select {
+	case <-done:
+		return
+	case <-time.After(killGracePeriod):
+	}
+
+	log.Warn().Msgf("process group %d did not exit after %s, killing it", pgid, killGracePeriod)
+	err = syscall.Kill(-pgid, syscall.SIGKILL)
+	if err != nil {
+		log.Error().Msgf("failed to kill process group %d: %s", pgid, err)
+	}
+
+	<-done
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Release is a staged ansible repo
+type Release struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+	Active    bool      `json:"active"`
+}
+
+// ActiveRelease returns the ID of the release the active symlink points to,
+// or an empty string if there is no active release
+func ActiveRelease(dataDir string) (string, error) {
+	target, err := os.Readlink(ActiveDir(dataDir))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("could not read active symlink: %s", err)
+	}
+
+	return filepath.Base(target), nil
+}
+
+// ListReleases returns the staged releases from oldest to newest
+func ListReleases(dataDir string) ([]Release, error) {
+	entries, err := os.ReadDir(StagingDir(dataDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read staging directory: %s", err)
+	}
+
+	activeRelease, err := ActiveRelease(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	releases := []Release{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		release := Release{
+			ID:     entry.Name(),
+			Path:   filepath.Join(StagingDir(dataDir), entry.Name()),
+			Active: entry.Name() == activeRelease,
+		}
+
+		// releases are named after the unix time they were staged at
+		timestamp, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err == nil {
+			release.CreatedAt = time.Unix(timestamp, 0)
+		}
+
+		releases = append(releases, release)
+	}
+
+	return releases, nil
+}
@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RunResult is the outcome of an ansible run parsed from the json callback.
+// The counts are summed over the hosts of the PLAY RECAP.
+type RunResult struct {
+	Ok           int      `json:"ok"`
+	Changed      int      `json:"changed"`
+	Failed       int      `json:"failed"`
+	Unreachable  int      `json:"unreachable"`
+	Skipped      int      `json:"skipped"`
+	ChangedTasks []string `json:"changed_tasks,omitempty"`
+	FailedTasks  []string `json:"failed_tasks,omitempty"`
+}
+
+// ansibleHostResult is the result of a task on a host in the json callback output
+type ansibleHostResult struct {
+	Changed     bool   `json:"changed"`
+	Failed      bool   `json:"failed"`
+	Skipped     bool   `json:"skipped"`
+	Unreachable bool   `json:"unreachable"`
+	Ignored     bool   `json:"ignored"`
+	Msg         string `json:"msg"`
+}
+
+// failed checks if the task failed on the host, whether the failure was ignored or not
+func (r ansibleHostResult) failed() bool {
+	return (r.Failed || r.Unreachable) && !r.Ignored
+}
+
+// ansibleJSONOutput is the document printed by the ansible json callback
+type ansibleJSONOutput struct {
+	Plays []struct {
+		Play struct {
+			Name string `json:"name"`
+		} `json:"play"`
+		Tasks []struct {
+			Task struct {
+				Name string `json:"name"`
+			} `json:"task"`
+			Hosts map[string]ansibleHostResult `json:"hosts"`
+		} `json:"tasks"`
+	} `json:"plays"`
+	Stats map[string]struct {
+		Ok          int `json:"ok"`
+		Changed     int `json:"changed"`
+		Failures    int `json:"failures"`
+		Unreachable int `json:"unreachable"`
+		Skipped     int `json:"skipped"`
+	} `json:"stats"`
+}
+
+// lastJSONDocument returns the last complete json callback document in output.
+// The document starts at the beginning of a line, the warnings printed
+// before or after it may hold braces too.
+func lastJSONDocument(output []byte) (*ansibleJSONOutput, error) {
+	var lastErr error
+	end := len(output)
+	for end > 0 {
+		start := bytes.LastIndexByte(output[:end], '{')
+		if start == -1 {
+			break
+		}
+
+		end = start
+		if start > 0 && output[start-1] != '\n' {
+			continue
+		}
+
+		var document ansibleJSONOutput
+		err := json.NewDecoder(bytes.NewReader(output[start:])).Decode(&document)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if document.Plays != nil || document.Stats != nil {
+			return &document, nil
+		}
+	}
+
+	if lastErr != nil {
+		return nil, fmt.Errorf("could not unmarshal ansible output: %s", lastErr)
+	}
+
+	return nil, fmt.Errorf("no json document in ansible output")
+}
+
+// ParseRunResult parses the output of ansible-playbook run with the json callback.
+// Failures of tasks with ignore_errors or rescued by a block are not failed tasks.
+// A host stops at its first failure that is not ignored, so that failure is the
+// last failed result of a host whose recap counts failures.
+func ParseRunResult(output []byte) (*RunResult, error) {
+	document, err := lastJSONDocument(output)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RunResult{}
+	failedHosts := map[string]bool{}
+	for host, stats := range document.Stats {
+		result.Ok += stats.Ok
+		result.Changed += stats.Changed
+		result.Failed += stats.Failures
+		result.Unreachable += stats.Unreachable
+		result.Skipped += stats.Skipped
+		failedHosts[host] = stats.Failures > 0 || stats.Unreachable > 0
+	}
+
+	// the play and task index of the failure of each failed host
+	type taskPosition struct{ play, task int }
+	failures := map[string]taskPosition{}
+	for playIndex, play := range document.Plays {
+		for taskIndex, task := range play.Tasks {
+			for host, hostResult := range task.Hosts {
+				if hostResult.failed() && failedHosts[host] {
+					failures[host] = taskPosition{playIndex, taskIndex}
+				}
+			}
+		}
+	}
+
+	for playIndex, play := range document.Plays {
+		for taskIndex, task := range play.Tasks {
+			changed, failed := false, false
+			for host, hostResult := range task.Hosts {
+				changed = changed || hostResult.Changed
+				failure, ok := failures[host]
+				if ok && failure.play == playIndex && failure.task == taskIndex {
+					failed = true
+					log.Error().Str("play", play.Play.Name).Str("task", task.Task.Name).Str("host", host).Msg(hostResult.Msg)
+				}
+			}
+
+			if changed {
+				result.ChangedTasks = append(result.ChangedTasks, task.Task.Name)
+			}
+
+			if failed {
+				result.FailedTasks = append(result.FailedTasks, task.Task.Name)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// changedTasks returns the changed tasks as a non-nil slice for logging
+func (r *RunResult) changedTasks() []string {
+	if r == nil || r.ChangedTasks == nil {
+		return []string{}
+	}
+
+	return r.ChangedTasks
+}
+
+// Log logs the PLAY RECAP of the run
+func (r *RunResult) Log() {
+	log.Info().
+		Int("ok", r.Ok).
+		Int("changed", r.Changed).
+		Int("failed", r.Failed).
+		Int("unreachable", r.Unreachable).
+		Int("skipped", r.Skipped).
+		Strs("failed_tasks", r.FailedTasks).
+		Msg("ansible play recap")
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseRunResult(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    *RunResult
+	}{
+		{
+			fixture: "changed.txt",
+			want:    &RunResult{Ok: 3, Changed: 1, ChangedTasks: []string{"install nginx"}},
+		},
+		{
+			fixture: "ignored.txt",
+			want:    &RunResult{Ok: 2, Changed: 1, ChangedTasks: []string{"check legacy agent"}},
+		},
+		{
+			fixture: "failed.txt",
+			want:    &RunResult{Ok: 1, Changed: 1, Failed: 1, ChangedTasks: []string{"check legacy agent"}, FailedTasks: []string{"start nginx"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			output, err := os.ReadFile(filepath.Join("testdata", "ansible", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := ParseRunResult(output)
+			if err != nil {
+				t.Fatalf("could not parse run result: %s", err)
+			}
+
+			if !reflect.DeepEqual(result, test.want) {
+				t.Errorf("got %+v, expected %+v", result, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRunResultWithoutDocument(t *testing.T) {
+	output, err := os.ReadFile(filepath.Join("testdata", "ansible", "no_document.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseRunResult(output)
+	if err == nil {
+		t.Error("parsed a run result from output without a json document")
+	}
+}
@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RetryPolicy is how a remote call is retried. Every attempt is bounded
+// by Timeout, and failed attempts are retried after an exponential backoff
+// from BaseDelay up to MaxDelay with full jitter.
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Timeout   time.Duration
+}
+
+// retryPolicy returns the configured retry policy with the per-call timeout
+func retryPolicy(agentConfig AgentConfig, timeout string) RetryPolicy {
+	return RetryPolicy{
+		Attempts:  agentConfig.RetryAttempts,
+		BaseDelay: parseOptionalDuration(agentConfig.RetryBaseDelay),
+		MaxDelay:  parseOptionalDuration(agentConfig.RetryMaxDelay),
+		Timeout:   parseOptionalDuration(timeout),
+	}
+}
+
+// backoff returns the delay before the retry following attempt,
+// a random duration up to BaseDelay doubled on every attempt and capped at MaxDelay
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// permanentError is an error that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent marks err as not worth retrying
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return permanentError{err: err}
+}
+
+// retryableStatus checks if a request that got statusCode is worth retrying,
+// server errors, timeouts and rate limits are
+func retryableStatus(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests
+}
+
+// statusError returns the error of an unexpected status, permanent unless retryableStatus
+func statusError(what string, statusCode int) error {
+	err := fmt.Errorf("could not get %s: unexpected status %d", what, statusCode)
+	if retryableStatus(statusCode) {
+		return err
+	}
+
+	return permanent(err)
+}
+
+// jfrogStatusPattern matches the status in errors returned by jfrog-client-go
+var jfrogStatusPattern = regexp.MustCompile(`server response: (\d{3})`)
+
+// isRetryable checks if a failed call is worth retrying. Errors marked
+// permanent, cancelled calls, an open circuit breaker and Artifactory
+// responses with a status that is not retryable are not.
+func isRetryable(err error) bool {
+	var permanentErr permanentError
+	if errors.As(err, &permanentErr) || errors.Is(err, context.Canceled) || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+
+	match := jfrogStatusPattern.FindStringSubmatch(err.Error())
+	if match != nil {
+		statusCode, _ := strconv.Atoi(match[1])
+		return retryableStatus(statusCode)
+	}
+
+	return true
+}
+
+// retry calls call until it succeeds, fails with an error that is not
+// retryable or the attempts of the policy are used up
+func retry(ctx context.Context, name string, policy RetryPolicy, call func(ctx context.Context) error) error {
+	attempts := policy.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			delay := policy.backoff(attempt - 2)
+			log.Warn().Msgf("%s failed, retrying in %s (attempt %d of %d): %s", name, delay.Round(time.Millisecond), attempt, attempts, err)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(delay):
+			}
+		}
+
+		err = callWithTimeout(ctx, policy.Timeout, call)
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+	}
+
+	if attempts == 1 {
+		return err
+	}
+
+	return fmt.Errorf("%s failed %d times: %w", name, attempts, err)
+}
+
+// callWithTimeout calls call with a context that is done after timeout,
+// no timeout when it is zero
+func callWithTimeout(ctx context.Context, timeout time.Duration, call func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return call(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := call(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s: %s", timeout, err)
+	}
+
+	return err
+}
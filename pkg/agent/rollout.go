@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jfrog/jfrog-client-go/artifactory/services"
+	"github.com/jfrog/jfrog-client-go/artifactory/services/utils"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// RolloutPercentProperty is the artifact property that holds
+	// the rollout percentage of the tarball in Artifactory
+	RolloutPercentProperty = "doan.rollout.percent"
+	// RolloutManifestName is the name of the rollout manifest
+	// that is looked up next to the tarball in Artifactory
+	RolloutManifestName = "rollout.json"
+	// rolloutBuckets is the number of buckets hosts are spread over
+	rolloutBuckets = 100
+
+	// HostIdentityAuto uses the droplet ID on droplets and the hostname elsewhere
+	HostIdentityAuto = "auto"
+	// HostIdentityDropletID always uses the droplet ID
+	HostIdentityDropletID = "droplet_id"
+	// HostIdentityHostname always uses the hostname
+	HostIdentityHostname = "hostname"
+)
+
+// HostIdentities are the values of rollout_identity
+var HostIdentities = []string{HostIdentityAuto, HostIdentityDropletID, HostIdentityHostname}
+
+// dmiVendorPath holds the vendor of the host's firmware
+var dmiVendorPath = "/sys/class/dmi/id/sys_vendor"
+
+// RolloutManifest is the JSON structure of the rollout manifest.
+// Release is the md5 or sha256 of the tarball the percentage applies to,
+// an empty Release applies the percentage to any tarball.
+type RolloutManifest struct {
+	Release string `json:"release"`
+	Percent int    `json:"percent"`
+}
+
+// getDropletID returns the droplet ID through the DO metadata API
+func getDropletID(ctx context.Context) (string, error) {
+	doIDUrl := dropletMetadataURL + "/id"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, doIDUrl, nil)
+	if err != nil {
+		return "", permanent(fmt.Errorf("could not create droplet id request: %s", err))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not get droplet id: %s", err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError("droplet id", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read droplet id: %s", err)
+	}
+
+	dropletID := strings.TrimSpace(string(body))
+	if dropletID == "" {
+		return "", fmt.Errorf("metadata API returned an empty droplet id")
+	}
+
+	return dropletID, nil
+}
+
+// GetDropletID returns the droplet ID through the DO metadata API.
+// Failed requests are retried with the configured retry policy.
+func GetDropletID(agentConfig AgentConfig) (string, error) {
+	var dropletID string
+	err := retry(context.Background(), "droplet id", retryPolicy(agentConfig, agentConfig.RemoteTimeout), func(ctx context.Context) error {
+		var err error
+		dropletID, err = getDropletID(ctx)
+		return err
+	})
+
+	return dropletID, err
+}
+
+// onDigitalOcean checks if the host is a droplet, which has a metadata API.
+// It is read from the firmware so it does not change while the host runs.
+func onDigitalOcean() bool {
+	vendor, err := os.ReadFile(dmiVendorPath)
+	return err == nil && strings.TrimSpace(string(vendor)) == "DigitalOcean"
+}
+
+// GetHostIdentity returns the identity the rollout bucket and splay of the host
+// are derived from: the droplet ID, or the hostname when rollout_identity is
+// hostname or, with auto, when the host is not a droplet. A droplet whose ID
+// cannot be read returns an error instead of switching to its hostname,
+// which would move it to another bucket.
+func GetHostIdentity(agentConfig AgentConfig) (string, error) {
+	useHostname := agentConfig.RolloutIdentity == HostIdentityHostname
+	if agentConfig.RolloutIdentity == HostIdentityAuto && !onDigitalOcean() {
+		useHostname = true
+	}
+
+	if useHostname {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("could not get hostname: %s", err)
+		}
+
+		return hostname, nil
+	}
+
+	dropletID, err := GetDropletID(agentConfig)
+	if err != nil {
+		return "", fmt.Errorf("could not get droplet id: %s", err)
+	}
+
+	return dropletID, nil
+}
+
+// RolloutBucket returns the stable bucket in [0, 100) of a host identity
+func RolloutBucket(hostIdentity string) int {
+	h := fnv.New32a()
+	h.Write([]byte(hostIdentity))
+	return int(h.Sum32() % rolloutBuckets)
+}
+
+// DownloadRolloutManifest downloads the rollout manifest next to the tarball.
+// It returns nil if there is no rollout manifest in Artifactory.
+func DownloadRolloutManifest(agentConfig AgentConfig) (*RolloutManifest, error) {
+	rtManager, err := CreateArtifactoryServicesManager(agentConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "doan-rollout-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create temp directory: %s", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	params := services.NewDownloadParams()
+	params.Pattern = path.Join(path.Dir(agentConfig.AnsibleRepoPath), RolloutManifestName)
+	params.Target = tmpDir + "/"
+	params.Flat = true
+
+	totalDownloaded, _, err := rtManager.DownloadFiles(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if totalDownloaded == 0 {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(filepath.Join(tmpDir, RolloutManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("could not read rollout manifest: %s", err)
+	}
+
+	var manifest RolloutManifest
+	err = json.Unmarshal(content, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal rollout manifest: %s", err)
+	}
+
+	return &manifest, nil
+}
+
+// GetRolloutPercent returns the rollout percentage of the tarball found in Artifactory.
+// The artifact property takes precedence over the rollout manifest,
+// and a tarball without either is rolled out to every host.
+func GetRolloutPercent(agentConfig AgentConfig, artifact utils.ResultItem) (int, error) {
+	for _, property := range artifact.Properties {
+		if property.Key != RolloutPercentProperty {
+			continue
+		}
+
+		percent, err := strconv.Atoi(strings.TrimSpace(property.Value))
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s property %q: %s", RolloutPercentProperty, property.Value, err)
+		}
+
+		return percent, nil
+	}
+
+	manifest, err := DownloadRolloutManifest(agentConfig)
+	if err != nil {
+		return 0, fmt.Errorf("failed to download rollout manifest: %s", err)
+	}
+
+	if manifest == nil {
+		return rolloutBuckets, nil
+	}
+
+	// a manifest written for another release holds back the new one
+	// until the manifest is updated for it
+	if manifest.Release != "" && manifest.Release != artifact.Actual_Md5 && manifest.Release != artifact.Sha256 {
+		log.Warn().Msgf("rollout manifest is for release %s, holding back %s", manifest.Release, artifact.Actual_Md5)
+		return 0, nil
+	}
+
+	return manifest.Percent, nil
+}
+
+// RolloutIncludesHost checks if the rollout percentage of the tarball
+// found in Artifactory covers the bucket of this host
+func RolloutIncludesHost(agentConfig AgentConfig, artifact utils.ResultItem) (bool, error) {
+	percent, err := GetRolloutPercent(agentConfig, artifact)
+	if err != nil {
+		return false, err
+	}
+
+	hostIdentity, err := GetHostIdentity(agentConfig)
+	if err != nil {
+		return false, err
+	}
+
+	bucket := RolloutBucket(hostIdentity)
+	log.Debug().Msgf("rollout at %d%%, host %s is in bucket %d", percent, hostIdentity, bucket)
+	return bucket < percent, nil
+}
@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	"github.com/go-co-op/gocron"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// newScheduler returns a scheduler in the configured timezone
+func newScheduler(agentConfig AgentConfig) (*gocron.Scheduler, error) {
+	location, err := time.LoadLocation(agentConfig.DaemonTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("could not load timezone %s: %s", agentConfig.DaemonTimezone, err)
+	}
+
+	s := gocron.NewScheduler(location)
+	// runs on start are scheduled separately, after the start delay
+	s.WaitForScheduleAll()
+	return s, nil
+}
+
+// scheduleDaemon schedules job on the daemon cron expression,
+// or on the daemon interval when no cron expression is configured
+func scheduleDaemon(s *gocron.Scheduler, agentConfig AgentConfig, job func()) error {
+	if agentConfig.DaemonSchedule != "" {
+		_, err := s.Cron(agentConfig.DaemonSchedule).Do(job)
+		if err != nil {
+			return fmt.Errorf("could not schedule %q: %s", agentConfig.DaemonSchedule, err)
+		}
+
+		return nil
+	}
+
+	_, err := s.Every(agentConfig.DaemonInterval).Do(job)
+	if err != nil {
+		return fmt.Errorf("could not schedule every %s: %s", agentConfig.DaemonInterval, err)
+	}
+
+	return nil
+}
+
+// validateSchedule checks that a cron expression can be scheduled in a timezone
+func validateSchedule(schedule, timezone string) string {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	_, err = gocron.NewScheduler(location).Cron(schedule).Do(func() {})
+	if err != nil {
+		return fmt.Sprintf("invalid cron expression %q: %s", schedule, err)
+	}
+
+	return ""
+}
+
+// shortestCronInterval returns the shortest time between two
+// of the next runs of a cron expression in location
+func shortestCronInterval(schedule string, location *time.Location) (time.Duration, error) {
+	cronSchedule, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return 0, err
+	}
+
+	var shortest time.Duration
+	next := cronSchedule.Next(time.Now().In(location))
+	for i := 0; i < 1000 && !next.IsZero(); i++ {
+		after := cronSchedule.Next(next)
+		if after.IsZero() {
+			break
+		}
+
+		if interval := after.Sub(next); shortest == 0 || interval < shortest {
+			shortest = interval
+		}
+
+		next = after
+	}
+
+	return shortest, nil
+}
+
+// validateDelay checks that the splay and jitter delaying a scheduled run
+// end before the next run is due, so delayed runs do not pile up
+func validateDelay(agentConfig AgentConfig) string {
+	delay := parseOptionalDuration(agentConfig.DaemonSplay) + parseOptionalDuration(agentConfig.DaemonJitter)
+	if delay <= 0 {
+		return ""
+	}
+
+	// the shortest time between two runs of the sync and apply schedules
+	intervals := map[string]time.Duration{
+		"sync_interval": parseOptionalDuration(agentConfig.SyncInterval),
+	}
+
+	if agentConfig.DaemonSchedule != "" {
+		location, err := time.LoadLocation(agentConfig.DaemonTimezone)
+		if err != nil {
+			location = time.UTC
+		}
+
+		intervals["daemon_schedule"], _ = shortestCronInterval(agentConfig.DaemonSchedule, location)
+	} else {
+		intervals["daemon_interval"] = parseOptionalDuration(agentConfig.DaemonInterval)
+	}
+
+	for _, key := range ConfigKeys() {
+		interval, ok := intervals[key]
+		if ok && interval > 0 && delay >= interval {
+			return fmt.Sprintf("daemon_splay plus daemon_jitter (%s) must be shorter than the %s of %s", delay, key, interval)
+		}
+	}
+
+	return ""
+}
+
+// hostSplay returns the fixed delay in [0, splay) of this host,
+// derived from its identity so it is stable across restarts
+func hostSplay(agentConfig AgentConfig, splay time.Duration) time.Duration {
+	if splay <= 0 {
+		return 0
+	}
+
+	hostIdentity, err := GetHostIdentity(agentConfig)
+	if err != nil {
+		log.Warn().Msgf("using a random splay: %s", err)
+		return time.Duration(rand.Int63n(int64(splay)))
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(hostIdentity))
+	return time.Duration(h.Sum64() % uint64(splay))
+}
+
+// parseOptionalDuration parses a duration that is zero when empty
+func parseOptionalDuration(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0
+	}
+
+	return duration
+}
+
+// delayed returns job delayed by the splay of this host
+// and a random jitter on every run, so the fleet does not
+// hit Artifactory at the same second
+func delayed(agentConfig AgentConfig, job func()) func() {
+	splay := hostSplay(agentConfig, parseOptionalDuration(agentConfig.DaemonSplay))
+	jitter := parseOptionalDuration(agentConfig.DaemonJitter)
+	log.Debug().Msgf("delaying scheduled runs by a splay of %s", splay)
+
+	return func() {
+		delay := splay
+		if jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(jitter)))
+		}
+
+		if delay > 0 {
+			log.Debug().Msgf("delaying scheduled run by %s", delay)
+			time.Sleep(delay)
+		}
+
+		job()
+	}
+}
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RunRecord is the outcome of a sync or apply.
+// Result is set for ansible runs whose results could be parsed.
+type RunRecord struct {
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+	Error      string     `json:"error,omitempty"`
+	TimedOut   bool       `json:"timed_out,omitempty"`
+	Triggers   []Trigger  `json:"triggers,omitempty"`
+	Result     *RunResult `json:"result,omitempty"`
+}
+
+// Succeeded checks if the run finished without an error
+func (r *RunRecord) Succeeded() bool {
+	return r != nil && r.Error == ""
+}
+
+// AgentState is the state the agent keeps between runs,
+// it is read by the status command
+type AgentState struct {
+	LastSync  *RunRecord   `json:"last_sync,omitempty"`
+	LastApply *RunRecord   `json:"last_apply,omitempty"`
+	LastCheck *RunRecord   `json:"last_check,omitempty"`
+	Drift     *DriftRecord `json:"drift,omitempty"`
+	// Tarball is the digest of the tarball the last deployed release was extracted from
+	Tarball string `json:"tarball,omitempty"`
+	// Circuit is the Artifactory circuit breaker, it is cleared when a call succeeds
+	Circuit *CircuitRecord `json:"artifactory_circuit,omitempty"`
+	// NotifiedFailure is the failure key of the last failed run notified,
+	// it is cleared when a run succeeds
+	NotifiedFailure string `json:"notified_failure,omitempty"`
+}
+
+// stateMutex serializes updates of the state file within the process
+var stateMutex sync.Mutex
+
+// ReadState reads the agent state, a missing state file is an empty state
+func ReadState(dataDir string) (AgentState, error) {
+	var state AgentState
+	content, err := os.ReadFile(stateFile(dataDir))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+
+	if err != nil {
+		return state, fmt.Errorf("could not read state file: %s", err)
+	}
+
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		return state, fmt.Errorf("could not unmarshal state file: %s", err)
+	}
+
+	return state, nil
+}
+
+// updateState applies update to the agent state and writes it back
+func updateState(dataDir string, update func(state *AgentState)) error {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	state, err := ReadState(dataDir)
+	if err != nil {
+		log.Warn().Msgf("resetting agent state: %s", err)
+		state = AgentState{}
+	}
+
+	update(&state)
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal state: %s", err)
+	}
+
+	tmpFile := stateFile(dataDir) + ".tmp"
+	err = os.WriteFile(tmpFile, content, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write state file: %s", err)
+	}
+
+	return os.Rename(tmpFile, stateFile(dataDir))
+}
+
+// newRunRecord returns the record of a run started at startedAt
+func newRunRecord(startedAt time.Time, result *RunResult, err error) *RunRecord {
+	record := &RunRecord{
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+		Result:     result,
+	}
+
+	if err != nil {
+		record.Error = err.Error()
+		record.TimedOut = errors.Is(err, ErrRunTimedOut)
+	}
+
+	return record
+}
+
+// recordSync stores the outcome of a sync in the agent state
+func recordSync(dataDir string, startedAt time.Time, err error) {
+	stateErr := updateState(dataDir, func(state *AgentState) {
+		state.LastSync = newRunRecord(startedAt, nil, err)
+	})
+
+	if stateErr != nil {
+		log.Error().Msgf("failed to record sync: %s", stateErr)
+	}
+}
+
+// recordTarball stores the digest of the tarball a deployed release was extracted from
+func recordTarball(dataDir string, digest TarballDigest) {
+	stateErr := updateState(dataDir, func(state *AgentState) {
+		state.Tarball = digest.String()
+	})
+
+	if stateErr != nil {
+		log.Error().Msgf("failed to record the deployed tarball: %s", stateErr)
+	}
+}
+
+// recordApply stores the outcome of an apply in the agent state
+func recordApply(dataDir string, startedAt time.Time, result *RunResult, err error) {
+	stateErr := updateState(dataDir, func(state *AgentState) {
+		state.LastApply = newRunRecord(startedAt, result, err)
+	})
+
+	if stateErr != nil {
+		log.Error().Msgf("failed to record apply: %s", stateErr)
+	}
+}
+
+// recordCheck stores the outcome of a check mode run in the agent state
+func recordCheck(dataDir string, startedAt time.Time, result *RunResult, err error) {
+	stateErr := updateState(dataDir, func(state *AgentState) {
+		state.LastCheck = newRunRecord(startedAt, result, err)
+	})
+
+	if stateErr != nil {
+		log.Error().Msgf("failed to record check: %s", stateErr)
+	}
+}
+
+// RecordTriggers stores what triggered the syncs, applies and checks
+// started since startedAt in the agent state
+func RecordTriggers(dataDir string, startedAt time.Time, triggers []Trigger) error {
+	return updateState(dataDir, func(state *AgentState) {
+		for _, record := range []*RunRecord{state.LastSync, state.LastApply, state.LastCheck} {
+			if record != nil && !record.StartedAt.Before(startedAt) {
+				record.Triggers = triggers
+			}
+		}
+	})
+}
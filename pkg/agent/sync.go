@@ -4,12 +4,14 @@ import (
 	"archive/tar"
 	"bufio"
 	"compress/gzip"
-	"crypto/md5"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/jfrog/jfrog-client-go/artifactory/services/utils"
 	"github.com/rs/zerolog/log"
 )
 
@@ -21,15 +23,19 @@ func Untar(source, destination string) error {
 	}
 
 	defer file.Close()
+	return untarReader(file, destination)
+}
 
+// untarReader un-tars a gzipped tarball read from source to a destination directory
+func untarReader(source io.Reader, destination string) error {
 	// Create the destination directory if it doesn't exist
-	err = os.Mkdir(destination, 0755)
+	err := os.Mkdir(destination, 0755)
 	// check if error is because directory already exists
 	if err != nil && !os.IsExist(err) {
 		return fmt.Errorf("could not create destination directory: %s", err)
 	}
 
-	gzipReader, err := gzip.NewReader(file)
+	gzipReader, err := gzip.NewReader(source)
 	if err != nil {
 		return fmt.Errorf("could not create gzip reader: %s", err)
 	}
@@ -46,43 +52,124 @@ func Untar(source, destination string) error {
 			return fmt.Errorf("could not read next file in archive: %s", err)
 		}
 
-		path := fmt.Sprintf("%s/%s", destination, hdr.Name)
-
-		// Create a directory if file is a directory
-		if hdr.FileInfo().IsDir() {
-			os.Mkdir(path, hdr.FileInfo().Mode())
-			continue
+		path, err := extractPath(destination, hdr.Name)
+		if err != nil {
+			return err
 		}
 
-		// Log file being extracted if debug is enabled
-		log.Debug().Msgf("Extracting %s", path)
-
-		outFile, err := os.Create(path)
+		err = checkNoSymlinks(destination, path)
 		if err != nil {
-			return fmt.Errorf("could not create file %s: %s", hdr.Name, err)
+			return err
 		}
 
-		defer outFile.Close()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// the directory stays writable for the entries extracted into it
+			err = os.Mkdir(path, hdr.FileInfo().Mode().Perm()|0700)
+			if err != nil && !os.IsExist(err) {
+				return fmt.Errorf("could not create directory %s: %s", hdr.Name, err)
+			}
+		case tar.TypeReg:
+			// Log file being extracted if debug is enabled
+			log.Debug().Msgf("Extracting %s", path)
+
+			err = extractFile(path, hdr.FileInfo().Mode().Perm(), tarReader)
+			if err != nil {
+				return fmt.Errorf("could not extract file %s: %s", hdr.Name, err)
+			}
+		case tar.TypeSymlink:
+			// the target is relative to the directory of the link, it is
+			// linked cleaned as checked, so it cannot go up through another link
+			if filepath.IsAbs(hdr.Linkname) {
+				return fmt.Errorf("refusing to extract symlink %s to absolute path %s", hdr.Name, hdr.Linkname)
+			}
+
+			target := filepath.Clean(hdr.Linkname)
+			_, err = extractPath(destination, filepath.Join(filepath.Dir(hdr.Name), target))
+			if err != nil {
+				return fmt.Errorf("refusing to extract symlink %s to %s outside of %s", hdr.Name, hdr.Linkname, destination)
+			}
+
+			err = os.Symlink(target, path)
+			if err != nil {
+				return fmt.Errorf("could not extract symlink %s: %s", hdr.Name, err)
+			}
+		case tar.TypeLink:
+			// the target of a hardlink is an earlier entry of the archive
+			target, err := extractPath(destination, hdr.Linkname)
+			if err != nil {
+				return fmt.Errorf("refusing to extract hardlink %s to %s outside of %s", hdr.Name, hdr.Linkname, destination)
+			}
+
+			err = os.Link(target, path)
+			if err != nil {
+				return fmt.Errorf("could not extract hardlink %s: %s", hdr.Name, err)
+			}
+		default:
+			log.Debug().Msgf("Skipping %s of type %q", hdr.Name, hdr.Typeflag)
+		}
+	}
 
-		// Copy over contents
-		if _, err := io.Copy(outFile, tarReader); err != nil {
-			return fmt.Errorf("could not copy file %s: %s", hdr.Name, err)
+	return nil
+}
+
+// extractPath returns the path an archive entry is extracted to,
+// refusing entries that would end up outside of destination
+func extractPath(destination, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("refusing to extract absolute path %s", name)
+	}
+
+	path := filepath.Join(destination, name)
+	root := filepath.Clean(destination)
+	if path != root && !strings.HasPrefix(path, root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("refusing to extract %s outside of %s", name, destination)
+	}
+
+	return path, nil
+}
+
+// checkNoSymlinks refuses to extract to path when it or one of its parent
+// directories in destination is a symlink extracted earlier, writing
+// through it would change the file it points to instead
+func checkNoSymlinks(destination, path string) error {
+	root := filepath.Clean(destination)
+	for current := path; current != root; current = filepath.Dir(current) {
+		info, err := os.Lstat(current)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to extract %s through symlink %s", path, current)
 		}
 	}
 
 	return nil
 }
 
-// Relink updates the symlinks to the active ansible repo
-func Relink(stagingRepoPath string) error {
+// extractFile writes the contents of an archive entry to path with mode
+func extractFile(path string, mode os.FileMode, contents io.Reader) error {
+	outFile, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(outFile, contents)
+	if err != nil {
+		outFile.Close()
+		return err
+	}
+
+	return outFile.Close()
+}
+
+// Relink updates the symlinks to the active ansible repo in dataDir
+func Relink(dataDir, stagingRepoPath string) error {
 	// Remove the current active symlink
-	err := os.Remove(DoanActiveDir)
+	err := os.Remove(ActiveDir(dataDir))
 	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("could not remove symlink: %s", err)
 	}
 
 	// Point the active symlink to the latest ansible repo
-	err = os.Symlink(stagingRepoPath, DoanActiveDir)
+	err = os.Symlink(stagingRepoPath, ActiveDir(dataDir))
 	if err != nil {
 		return fmt.Errorf("could not create symlink: %s", err)
 	}
@@ -90,120 +177,271 @@ func Relink(stagingRepoPath string) error {
 	return nil
 }
 
-// RemoveOldestStagingRepo removes the oldest staging repo
-// if there are more than maxStagingRepos
-func RemoveOldestStagingRepo(maxStagingRepos int) error {
+// RemoveOldestStagingRepo removes the oldest staging repos in dataDir
+// while there are more than maxStagingRepos. The active release is never
+// removed, even when it is the oldest after a rollback.
+func RemoveOldestStagingRepo(dataDir string, maxStagingRepos int) error {
 	// Get the list of staging repos
-	stagingRepos, err := os.ReadDir(DoanStagingDir)
+	stagingRepos, err := os.ReadDir(StagingDir(dataDir))
 	if err != nil {
 		return fmt.Errorf("could not read staging directory: %s", err)
 	}
 
-	// Remove the oldest staging repo if there are more than maxStagingRepos
-	if len(stagingRepos) > maxStagingRepos {
-		oldestStagingRepo := stagingRepos[0]
-		oldestStagingRepoPath := fmt.Sprintf("%s/%s", DoanStagingDir, oldestStagingRepo.Name())
-		err = os.RemoveAll(oldestStagingRepoPath)
+	activeRelease, err := ActiveRelease(dataDir)
+	if err != nil {
+		return err
+	}
+
+	// Remove the oldest staging repos if there are more than maxStagingRepos
+	excess := len(stagingRepos) - maxStagingRepos
+	for _, stagingRepo := range stagingRepos {
+		if excess <= 0 {
+			break
+		}
+
+		if stagingRepo.Name() == activeRelease {
+			continue
+		}
+
+		stagingRepoPath := fmt.Sprintf("%s/%s", StagingDir(dataDir), stagingRepo.Name())
+		err = os.RemoveAll(stagingRepoPath)
 		if err != nil {
 			return fmt.Errorf("could not remove oldest staging repo: %s", err)
 		}
 
-		// Recursively call RemoveOldestStagingRepo
-		// until there are no more than maxStagingRepos
-		RemoveOldestStagingRepo(maxStagingRepos)
+		excess--
+	}
+
+	// Free the objects only the removed releases linked to, a failure
+	// only keeps unused objects around until the next sync
+	err = pruneObjects(dataDir)
+	if err != nil {
+		log.Error().Msgf("failed to prune object store: %s", err)
 	}
 
 	return nil
 }
 
-func GetLocalMD5Sum(agentConfig AgentConfig) (string, error) {
-	md5SumPath := fmt.Sprintf(
-		"%s/%s/%s",
-		DoanTarBallDir,
-		agentConfig.AnsibleNameSpace,
-		agentConfig.AnsibleTarballName,
-	)
+// DeployRepo untars the latest ansible repo
+// and updates symlinks to the active ansible repo.
+// DeployRepo returns an error if the relinking fails.
+// The sync runs between the pre_sync and post_sync hooks
+// and the outcome is recorded in the agent state.
+func DeployRepo(agentConfig AgentConfig) error {
+	startedAt := time.Now()
+	err := runStepHooks(agentConfig, "sync", ActiveDir(agentConfig.DataDir), func() error {
+		return deployRepo(agentConfig)
+	})
+	recordSync(agentConfig.DataDir, startedAt, err)
+	return err
+}
+
+func deployRepo(agentConfig AgentConfig) error {
+	artifact, err := GetRemoteArtifact(agentConfig)
+	if err != nil {
+		return fmt.Errorf("failed to get remote artifact: %w", err)
+	}
+
+	if artifact.Name == "" {
+		return fmt.Errorf("no tarball matches %s", agentConfig.AnsibleRepoPath)
+	}
 
-	f, err := os.Open(md5SumPath)
+	digest := ArtifactDigest(artifact)
+	state, err := ReadState(agentConfig.DataDir)
 	if err != nil {
-		return "", fmt.Errorf("could not open file: %s", err)
+		log.Error().Msgf("failed to read the deployed tarball: %s", err)
 	}
 
-	defer f.Close()
+	if state.Tarball == digest.String() {
+		log.Info().Msgf("tarball %s is deployed, skipping deploy", digest)
+		return nil
+	}
 
-	h := md5.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", fmt.Errorf("could not copy file: %s", err)
+	// Hold back the new release until its rollout covers this host
+	rolloutIncludesHost, err := RolloutIncludesHost(agentConfig, artifact)
+	if err != nil {
+		return fmt.Errorf("failed to check rollout: %s", err)
 	}
 
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
-}
+	if !rolloutIncludesHost {
+		log.Info().Msgf("rollout does not cover this host yet, skipping deploy")
+		return nil
+	}
 
-// CompareMD5Sums checls if md5sum in artifactory matches
-// the md5sum in the latest tarball
-// CompareMD5Sums returns false if the md5sums do not match
-// and returns an error if there is an issue getting the md5sums
-func CompareMD5Sums(agentConfig AgentConfig) (bool, error) {
-	remoteMD5Sum, err := GetRemoteMD5Sum(agentConfig)
+	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	stagingRepoPath := fmt.Sprintf("%s/%s", StagingDir(agentConfig.DataDir), timestamp)
+	err = stageRelease(agentConfig, artifact, stagingRepoPath)
 	if err != nil {
-		return false, fmt.Errorf("failed to get remote md5sum: %s", err)
+		// a partly staged release is never activated
+		os.RemoveAll(stagingRepoPath)
+		return err
 	}
 
-	localMD5Sum, err := GetLocalMD5Sum(agentConfig)
+	// Relink the active ansible repo with the latest staging repo
+	err = activateRelease(agentConfig, stagingRepoPath)
 	if err != nil {
-		return false, fmt.Errorf("failed to get local md5sum: %s", err)
+		// the release never ran, the next sync stages it again
+		os.RemoveAll(stagingRepoPath)
+		return fmt.Errorf("failed to relink ansible repo: %s", err)
 	}
 
-	log.Debug().Msgf("remote md5sum: %s ,local sum: %s", remoteMD5Sum, localMD5Sum)
-	return remoteMD5Sum == localMD5Sum, nil
+	recordTarball(agentConfig.DataDir, digest)
+
+	// Remove the oldest staging repos now that the new release is active
+	err = RemoveOldestStagingRepo(agentConfig.DataDir, agentConfig.MaxStagingRepos)
+	if err != nil {
+		log.Error().Msgf("failed to remove oldest staging repo: %s", err)
+	}
+
+	err = pruneTarballCache(agentConfig.DataDir, digest)
+	if err != nil {
+		log.Error().Msgf("failed to prune the tarball cache: %s", err)
+	}
+
+	return nil
 }
 
-// Untar the latest ansible repo
-// and updates symlinks to the active ansible repo.
-// DeployRepo returns an error if the relinking fails.
-func DeployRepo(agentConfig AgentConfig) error {
-	checksumMatch, err := CompareMD5Sums(agentConfig)
+// stageRelease extracts the tarball into stagingRepoPath, either from the tarball
+// cache after downloading it there or while streaming it when stream_extract is set.
+// Either way the tarball is verified against its checksums before it is extracted
+// or before the extracted release is kept. With delta_updates, a release with
+// a file manifest is assembled from the object store instead. With dedupe_releases,
+// the files of an extracted release are hardlinked to the object store.
+func stageRelease(agentConfig AgentConfig, artifact utils.ResultItem, stagingRepoPath string) error {
+	if agentConfig.DeltaUpdates {
+		manifest, err := GetFileManifest(agentConfig, artifact)
+		switch {
+		case err != nil:
+			log.Warn().Msgf("downloading the whole tarball: failed to get file manifest: %s", err)
+		case manifest == nil:
+			log.Debug().Msgf("downloading the whole tarball: no file manifest is published")
+		case !manifest.describes(artifact):
+			log.Warn().Msgf("downloading the whole tarball: file manifest is for release %s", manifest.Release)
+		case !manifest.complete():
+			log.Warn().Msgf("downloading the whole tarball: file manifest does not list the directories of the bundle, republish it with doan manifest")
+		default:
+			err = stageDelta(agentConfig, artifact, manifest, stagingRepoPath)
+			if err != nil {
+				return fmt.Errorf("failed to assemble ansible repo: %w", err)
+			}
+
+			return nil
+		}
+	}
+
+	if agentConfig.StreamExtract {
+		err := StreamRepo(agentConfig, artifact, stagingRepoPath)
+		if err != nil {
+			return fmt.Errorf("failed to stream ansible repo: %w", err)
+		}
+	} else {
+		// Download the latest ansible repo into the tarball cache
+		latestTarballPath, err := DownloadRepo(agentConfig, artifact)
+		if err != nil {
+			return fmt.Errorf("failed to download ansible repo: %w", err)
+		}
+
+		// Untar the latest ansible repo to a staging directory
+		err = Untar(latestTarballPath, stagingRepoPath)
+		if err != nil {
+			return fmt.Errorf("failed to untar ansible repo: %s", err)
+		}
+	}
+
+	if agentConfig.DedupeReleases {
+		err := dedupeRelease(agentConfig.DataDir, stagingRepoPath)
+		if err != nil {
+			// the release is complete, it just takes more space
+			log.Error().Msgf("failed to deduplicate release: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Rollback activates an older staged release again, the newest release
+// staged before the active one when releaseID is empty. The release stays
+// active until a new tarball is deployed.
+func Rollback(agentConfig AgentConfig, releaseID string) (string, error) {
+	activeRelease, err := ActiveRelease(agentConfig.DataDir)
 	if err != nil {
-		log.Error().Msgf("failed to compare md5sums: %s", err)
+		return "", err
 	}
 
-	if checksumMatch {
-		log.Info().Msgf("md5sums match, skipping deploy")
-		return nil
+	if releaseID == "" {
+		releases, err := ListReleases(agentConfig.DataDir)
+		if err != nil {
+			return "", err
+		}
+
+		// releases are listed from oldest to newest
+		for _, release := range releases {
+			if release.ID == activeRelease {
+				break
+			}
+
+			releaseID = release.ID
+		}
+
+		if releaseID == "" {
+			return "", fmt.Errorf("no release was staged before the active release %s", activeRelease)
+		}
 	}
 
-	// Download the latest ansible repo
-	err = DownloadRepo(agentConfig)
+	releasePath, err := ReleasePath(agentConfig.DataDir, releaseID)
 	if err != nil {
-		return fmt.Errorf("failed to download ansible repo: %s", err)
+		return "", err
 	}
 
-	// Untar the latest ansible repo to a staging directory
-	latestTarballPath := fmt.Sprintf(
-		"%s/%s/%s",
-		DoanTarBallDir,
-		agentConfig.AnsibleNameSpace,
-		agentConfig.AnsibleTarballName,
-	)
+	if filepath.Base(releasePath) == activeRelease {
+		return "", fmt.Errorf("release %s is already active", activeRelease)
+	}
 
-	timestamp := fmt.Sprintf("%d", time.Now().Unix())
-	stagingRepoPath := fmt.Sprintf("%s/%s", DoanStagingDir, timestamp)
-	err = Untar(latestTarballPath, stagingRepoPath)
+	err = activateRelease(agentConfig, releasePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to relink ansible repo: %s", err)
+	}
+
+	return filepath.Base(releasePath), nil
+}
+
+// activateRelease relinks the active ansible repo to a staged release
+// and notifies whether a new release was activated or an older one rolled back to.
+// A failing galaxy install or pre_activate hook aborts the relink.
+func activateRelease(agentConfig AgentConfig, releasePath string) error {
+	previousRelease, err := ActiveRelease(agentConfig.DataDir)
 	if err != nil {
-		return fmt.Errorf("failed to untar ansible repo: %s", err)
+		return err
 	}
 
-	// Remove the oldest staging repo if there are more than maxStagingRepos
-	err = RemoveOldestStagingRepo(agentConfig.MaxStagingRepos)
+	// the roles and collections of the release must be there before it can run
+	err = installGalaxyRequirements(agentConfig, releasePath)
 	if err != nil {
-		return fmt.Errorf("failed to remove oldest staging repo: %s", err)
+		return err
 	}
 
-	// Relink the active ansible repo with the latest staging repo
-	err = Relink(stagingRepoPath)
+	err = RunHook(agentConfig, HookPreActivate, HookContext{
+		Step:            "activate",
+		ReleasePath:     releasePath,
+		PreviousRelease: previousRelease,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to relink ansible repo: %s", err)
+		return err
+	}
+
+	err = Relink(agentConfig.DataDir, releasePath)
+	if err != nil {
+		return err
+	}
+
+	eventType := EventReleaseActivated
+	release := filepath.Base(releasePath)
+	// releases are named after the unix time they were staged at
+	if previousRelease != "" && len(release) == len(previousRelease) && release < previousRelease {
+		eventType = EventRollback
 	}
 
+	log.Info().Str("release", release).Str("previous_release", previousRelease).Msg("activated release")
+	Notify(agentConfig, NewEvent(agentConfig.DataDir, eventType, nil, nil))
 	return nil
 }
@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarball returns a gzipped tarball holding the headers, regular files
+// contain their name
+func tarball(t *testing.T, headers ...tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, hdr := range headers {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+
+		err := tarWriter.WriteHeader(&hdr)
+		if err == nil && hdr.Typeflag == tar.TypeReg {
+			_, err = tarWriter.Write([]byte(hdr.Name))
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+func TestUntarReader(t *testing.T) {
+	destination := filepath.Join(t.TempDir(), "release")
+	source := tarball(t,
+		tar.Header{Name: "roles/", Typeflag: tar.TypeDir, Mode: 0750},
+		tar.Header{Name: "roles/main.yml", Typeflag: tar.TypeReg, Mode: 0644},
+		tar.Header{Name: "site.yml", Typeflag: tar.TypeReg, Mode: 0644},
+		tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		tar.Header{Name: "bin/deploy.sh", Typeflag: tar.TypeReg, Mode: 0755},
+		tar.Header{Name: "roles/site.yml", Linkname: "../site.yml", Typeflag: tar.TypeSymlink},
+		tar.Header{Name: "main.yml", Linkname: "roles/main.yml", Typeflag: tar.TypeLink},
+	)
+
+	err := untarReader(source, destination)
+	if err != nil {
+		t.Fatalf("could not untar: %s", err)
+	}
+
+	contents := map[string]string{
+		"roles/main.yml": "roles/main.yml",
+		"site.yml":       "site.yml",
+		"roles/site.yml": "site.yml",
+		"main.yml":       "roles/main.yml",
+	}
+
+	for name, want := range contents {
+		content, err := os.ReadFile(filepath.Join(destination, name))
+		if err != nil || string(content) != want {
+			t.Errorf("%s was not extracted: %q, %v", name, content, err)
+		}
+	}
+
+	modes := map[string]os.FileMode{
+		"roles":         0750,
+		"bin/deploy.sh": 0755,
+		"site.yml":      0644,
+	}
+
+	for name, want := range modes {
+		info, err := os.Stat(filepath.Join(destination, name))
+		if err != nil {
+			t.Errorf("could not stat %s: %s", name, err)
+			continue
+		}
+
+		if info.Mode().Perm() != want {
+			t.Errorf("%s has mode %s, expected %s", name, info.Mode().Perm(), want)
+		}
+	}
+}
+
+func TestUntarReaderRefusesEscapingEntries(t *testing.T) {
+	tests := []struct {
+		name string
+		hdr  tar.Header
+	}{
+		{"parent directory", tar.Header{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0644}},
+		{"nested parent directory", tar.Header{Name: "roles/../../escaped", Typeflag: tar.TypeReg, Mode: 0644}},
+		{"absolute path", tar.Header{Name: "/tmp/escaped", Typeflag: tar.TypeReg, Mode: 0644}},
+		{"absolute symlink", tar.Header{Name: "escaped", Linkname: "/etc", Typeflag: tar.TypeSymlink}},
+		{"escaping symlink", tar.Header{Name: "roles/escaped", Linkname: "../../outside", Typeflag: tar.TypeSymlink}},
+		{"absolute hardlink", tar.Header{Name: "escaped", Linkname: "/etc/passwd", Typeflag: tar.TypeLink}},
+		{"escaping hardlink", tar.Header{Name: "escaped", Linkname: "../outside", Typeflag: tar.TypeLink}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			destination := filepath.Join(dir, "release")
+			err := os.WriteFile(filepath.Join(dir, "outside"), []byte("outside"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = untarReader(tarball(t, test.hdr), destination)
+			if err == nil {
+				t.Fatal("extracted an entry escaping the destination")
+			}
+
+			if _, err := os.Lstat(filepath.Join(dir, "escaped")); err == nil {
+				t.Error("entry was written outside of the destination")
+			}
+		})
+	}
+}
+
+func TestUntarReaderRefusesWritesThroughSymlinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []tar.Header
+	}{
+		{"file over symlink", []tar.Header{
+			{Name: "site.yml", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "link.yml", Linkname: "site.yml", Typeflag: tar.TypeSymlink},
+			{Name: "link.yml", Typeflag: tar.TypeReg, Mode: 0644},
+		}},
+		{"file in symlinked directory", []tar.Header{
+			{Name: "roles/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "linked", Linkname: "roles", Typeflag: tar.TypeSymlink},
+			{Name: "linked/main.yml", Typeflag: tar.TypeReg, Mode: 0644},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destination := filepath.Join(t.TempDir(), "release")
+			err := untarReader(tarball(t, test.headers...), destination)
+			if err == nil {
+				t.Fatal("extracted an entry through a symlink")
+			}
+		})
+	}
+}
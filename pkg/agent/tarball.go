@@ -0,0 +1,305 @@
+package agent
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jfrog/jfrog-client-go/artifactory/services/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// TarballDigest is the checksum a tarball is cached under,
+// its sha256 when Artifactory has calculated it and its md5 otherwise
+type TarballDigest struct {
+	Algorithm string
+	Hex       string
+}
+
+func (d TarballDigest) String() string {
+	return d.Algorithm + ":" + d.Hex
+}
+
+// ArtifactDigest returns the digest of the tarball found in Artifactory
+func ArtifactDigest(artifact utils.ResultItem) TarballDigest {
+	if artifact.Sha256 != "" {
+		return TarballDigest{Algorithm: "sha256", Hex: strings.ToLower(artifact.Sha256)}
+	}
+
+	return TarballDigest{Algorithm: "md5", Hex: strings.ToLower(artifact.Actual_Md5)}
+}
+
+// CachedTarballPath returns the path of the tarball with digest in the tarball cache,
+// downloads are promoted to it and releases are extracted from it
+func CachedTarballPath(dataDir string, digest TarballDigest) string {
+	return filepath.Join(TarBallDir(dataDir), digest.Algorithm+"-"+digest.Hex+".tar.gz")
+}
+
+// partialTarballPath returns the temp file a tarball is downloaded to,
+// it is kept across failed attempts so the download can be resumed
+func partialTarballPath(dataDir string, digest TarballDigest) string {
+	return CachedTarballPath(dataDir, digest) + ".part"
+}
+
+// downloadTarball downloads the artifact to its temp file, resuming a previous
+// download when the server supports range requests, verifies it against the
+// checksums in Artifactory and renames it into the tarball cache
+func downloadTarball(ctx context.Context, agentConfig AgentConfig, artifact utils.ResultItem) (string, error) {
+	digest := ArtifactDigest(artifact)
+	if digest.Hex == "" {
+		return "", permanent(fmt.Errorf("artifactory has no checksum of %s", artifact.GetItemRelativePath()))
+	}
+
+	tarballPath := CachedTarballPath(agentConfig.DataDir, digest)
+	if _, err := os.Stat(tarballPath); err == nil {
+		log.Info().Msgf("tarball %s is cached", digest)
+		return tarballPath, nil
+	}
+
+	err := os.MkdirAll(TarBallDir(agentConfig.DataDir), 0755)
+	if err != nil {
+		return "", permanent(fmt.Errorf("could not create directory %s: %s", TarBallDir(agentConfig.DataDir), err))
+	}
+
+	partialPath := partialTarballPath(agentConfig.DataDir, digest)
+	err = downloadArtifact(ctx, agentConfig, artifact, partialPath)
+	if err != nil {
+		return "", err
+	}
+
+	err = verifyTarball(partialPath, artifact)
+	if err != nil {
+		// a corrupt download is not resumed
+		os.Remove(partialPath)
+		return "", err
+	}
+
+	err = os.Rename(partialPath, tarballPath)
+	if err != nil {
+		return "", permanent(fmt.Errorf("could not promote %s into the tarball cache: %s", partialPath, err))
+	}
+
+	log.Info().Msgf("downloaded tarball %s", digest)
+	return tarballPath, nil
+}
+
+// newDownloadRequest returns an authenticated request downloading the file
+// at itemPath, relative to the Artifactory URL, and the client to send it with
+func newDownloadRequest(ctx context.Context, agentConfig AgentConfig, itemPath string) (*http.Client, *http.Request, error) {
+	rtDetails, err := artifactoryDetails(agentConfig)
+	if err != nil {
+		return nil, nil, permanent(err)
+	}
+
+	serviceConfig, err := newArtifactoryServiceConfig(ctx, rtDetails, 0)
+	if err != nil {
+		return nil, nil, permanent(err)
+	}
+
+	client, err := newArtifactoryHTTPClient(serviceConfig)
+	if err != nil {
+		return nil, nil, permanent(err)
+	}
+
+	downloadURL := strings.TrimSuffix(rtDetails.GetUrl(), "/") + (&url.URL{Path: "/" + itemPath}).EscapedPath()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return nil, nil, permanent(fmt.Errorf("could not create download request: %s", err))
+	}
+
+	setArtifactoryAuth(req, rtDetails)
+	return client, req, nil
+}
+
+// downloadArtifact streams the artifact into partialPath, asking the server
+// for the missing bytes only when part of it was downloaded before
+func downloadArtifact(ctx context.Context, agentConfig AgentConfig, artifact utils.ResultItem, partialPath string) error {
+	client, req, err := newDownloadRequest(ctx, agentConfig, artifact.GetItemRelativePath())
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return permanent(fmt.Errorf("could not open %s: %s", partialPath, err))
+	}
+
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return permanent(fmt.Errorf("could not seek %s: %s", partialPath, err))
+	}
+
+	if offset > 0 && (artifact.Size == 0 || offset < artifact.Size) {
+		log.Info().Msgf("resuming download of %s at %d bytes", artifact.Name, offset)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not download %s: %s", artifact.Name, err)
+	}
+
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server sends the whole file, start over
+		err = file.Truncate(0)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+
+		if err != nil {
+			return permanent(fmt.Errorf("could not truncate %s: %s", partialPath, err))
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is not a prefix of the artifact, start over on the next attempt
+		file.Truncate(0)
+		return fmt.Errorf("could not resume download of %s", artifact.Name)
+	default:
+		return statusError(artifact.Name, resp.StatusCode)
+	}
+
+	_, err = io.Copy(file, resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not download %s: %s", artifact.Name, err)
+	}
+
+	return nil
+}
+
+// tarballHasher hashes a tarball with the algorithms Artifactory reports checksums in
+type tarballHasher struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newTarballHasher() *tarballHasher {
+	return &tarballHasher{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (h *tarballHasher) Write(p []byte) (int, error) {
+	h.md5.Write(p)
+	return h.sha256.Write(p)
+}
+
+// verify checks the hashed tarball against the checksums in Artifactory
+func (h *tarballHasher) verify(artifact utils.ResultItem) error {
+	checksums := []struct {
+		algorithm string
+		expected  string
+		actual    string
+	}{
+		{"md5", artifact.Actual_Md5, fmt.Sprintf("%x", h.md5.Sum(nil))},
+		{"sha256", artifact.Sha256, fmt.Sprintf("%x", h.sha256.Sum(nil))},
+	}
+
+	for _, checksum := range checksums {
+		if checksum.expected != "" && !strings.EqualFold(checksum.expected, checksum.actual) {
+			return fmt.Errorf("%s of %s is %s, expected %s", checksum.algorithm, artifact.Name, checksum.actual, checksum.expected)
+		}
+	}
+
+	return nil
+}
+
+// verifyTarball checks the downloaded file against the checksums in Artifactory
+func verifyTarball(path string, artifact utils.ResultItem) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %s", path, err)
+	}
+
+	defer file.Close()
+
+	hasher := newTarballHasher()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %s", path, err)
+	}
+
+	return hasher.verify(artifact)
+}
+
+// streamTarball extracts the artifact into destination while it is downloaded,
+// hashing the body on the way. The extracted release is removed unless the
+// whole body matches the checksums in Artifactory, so it is never activated.
+func streamTarball(ctx context.Context, agentConfig AgentConfig, artifact utils.ResultItem, destination string) error {
+	if ArtifactDigest(artifact).Hex == "" {
+		return permanent(fmt.Errorf("artifactory has no checksum of %s", artifact.GetItemRelativePath()))
+	}
+
+	client, req, err := newDownloadRequest(ctx, agentConfig, artifact.GetItemRelativePath())
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not download %s: %s", artifact.Name, err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(artifact.Name, resp.StatusCode)
+	}
+
+	// a previous attempt may have left a partial release behind
+	err = os.RemoveAll(destination)
+	if err != nil {
+		return permanent(fmt.Errorf("could not remove %s: %s", destination, err))
+	}
+
+	hasher := newTarballHasher()
+	body := io.TeeReader(resp.Body, hasher)
+	err = untarReader(body, destination)
+	if err == nil {
+		// the archive may end before the body, the padding is hashed too
+		_, err = io.Copy(io.Discard, body)
+	}
+
+	if err == nil {
+		err = hasher.verify(artifact)
+	}
+
+	if err != nil {
+		os.RemoveAll(destination)
+		return fmt.Errorf("could not extract %s: %s", artifact.Name, err)
+	}
+
+	log.Info().Msgf("extracted tarball %s while downloading it", ArtifactDigest(artifact))
+	return nil
+}
+
+// pruneTarballCache removes the cached tarballs and partial downloads
+// other than the tarball with digest
+func pruneTarballCache(dataDir string, digest TarballDigest) error {
+	entries, err := os.ReadDir(TarBallDir(dataDir))
+	if err != nil {
+		return fmt.Errorf("could not read tarball cache: %s", err)
+	}
+
+	keep := filepath.Base(CachedTarballPath(dataDir, digest))
+	for _, entry := range entries {
+		if entry.Name() == keep {
+			continue
+		}
+
+		err = os.RemoveAll(filepath.Join(TarBallDir(dataDir), entry.Name()))
+		if err != nil {
+			return fmt.Errorf("could not remove %s from the tarball cache: %s", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/jfrog/jfrog-client-go/access"
+	"github.com/jfrog/jfrog-client-go/artifactory/services"
+	"github.com/jfrog/jfrog-client-go/auth"
+	"github.com/jfrog/jfrog-client-go/config"
+	"github.com/rs/zerolog/log"
+
+	accessAuth "github.com/jfrog/jfrog-client-go/access/auth"
+	artifactoryAuth "github.com/jfrog/jfrog-client-go/artifactory/auth"
+)
+
+// CachedToken is an access token refreshed by doan.
+// Source is the refresh token from the configuration the
+// token was derived from, so a reconfigured server drops the cache.
+type CachedToken struct {
+	Source       string `json:"source"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenCacheMutex serializes refreshes, as every refresh
+// invalidates the refresh token it was made with
+var tokenCacheMutex sync.Mutex
+
+// lockTokenCache takes an flock on the token cache so doan processes, like the
+// daemon and a doan apply, do not refresh at the same time and rotate the
+// refresh token out from under each other. It returns the unlock function.
+func lockTokenCache(dataDir string) (func(), error) {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create directory %s: %s", dataDir, err)
+	}
+
+	file, err := os.OpenFile(tokenCacheFile(dataDir)+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open token cache lock: %s", err)
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not lock %s: %s", file.Name(), err)
+	}
+
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// readTokenCache reads the refreshed tokens keyed by server ID
+func readTokenCache(dataDir string) map[string]CachedToken {
+	tokens := map[string]CachedToken{}
+	content, err := os.ReadFile(tokenCacheFile(dataDir))
+	if err != nil {
+		return tokens
+	}
+
+	err = json.Unmarshal(content, &tokens)
+	if err != nil {
+		log.Warn().Msgf("ignoring invalid token cache %s: %s", tokenCacheFile(dataDir), err)
+		return map[string]CachedToken{}
+	}
+
+	return tokens
+}
+
+// writeTokenCache writes the refreshed tokens readable by the owner only
+func writeTokenCache(dataDir string, tokens map[string]CachedToken) error {
+	content, err := json.Marshal(tokens)
+	if err != nil {
+		return fmt.Errorf("could not marshal token cache: %s", err)
+	}
+
+	tmpFile := tokenCacheFile(dataDir) + ".tmp"
+	err = os.WriteFile(tmpFile, content, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write token cache: %s", err)
+	}
+
+	return os.Rename(tmpFile, tokenCacheFile(dataDir))
+}
+
+// tokenNeedsRefresh checks if an access token expires within the refresh window.
+// Tokens that cannot be parsed or never expire are not refreshed.
+func tokenNeedsRefresh(accessToken string) bool {
+	if accessToken == "" {
+		return true
+	}
+
+	expiry, err := auth.ExtractExpiryFromAccessToken(accessToken)
+	if err != nil || expiry <= 0 {
+		return false
+	}
+
+	minutesLeft, err := auth.GetTokenMinutesLeft(accessToken)
+	if err != nil {
+		return false
+	}
+
+	return minutesLeft <= auth.RefreshBeforeExpiryMinutes
+}
+
+// RefreshServerTokens returns the server with a valid access token.
+// It applies tokens refreshed earlier and cached in dataDir and refreshes
+// the access token through Artifactory or JFrog Access when it is about to expire.
+func RefreshServerTokens(dataDir string, server JFrogServers) (JFrogServers, error) {
+	source := server.ArtifactoryRefreshToken
+	if source == "" {
+		source = server.RefreshToken
+	}
+
+	if source == "" {
+		return server, nil
+	}
+
+	tokenCacheMutex.Lock()
+	defer tokenCacheMutex.Unlock()
+
+	unlock, err := lockTokenCache(dataDir)
+	if err != nil {
+		log.Warn().Msgf("refreshing without locking the token cache: %s", err)
+	} else {
+		defer unlock()
+	}
+
+	tokens := readTokenCache(dataDir)
+	cached, ok := tokens[server.ServerID]
+	if ok && cached.Source == source {
+		server.AccessToken = cached.AccessToken
+		if server.ArtifactoryRefreshToken != "" {
+			server.ArtifactoryRefreshToken = cached.RefreshToken
+		} else {
+			server.RefreshToken = cached.RefreshToken
+		}
+	}
+
+	if !tokenNeedsRefresh(server.AccessToken) {
+		return server, nil
+	}
+
+	log.Info().Msgf("refreshing access token of server %s", server.ServerID)
+	var tokenInfo auth.CreateTokenResponseData
+	if server.ArtifactoryRefreshToken != "" {
+		tokenInfo, err = refreshArtifactoryToken(server)
+	} else {
+		tokenInfo, err = refreshAccessToken(server)
+	}
+
+	if err != nil {
+		return server, err
+	}
+
+	server.AccessToken = tokenInfo.AccessToken
+	if server.ArtifactoryRefreshToken != "" {
+		server.ArtifactoryRefreshToken = tokenInfo.RefreshToken
+	} else {
+		server.RefreshToken = tokenInfo.RefreshToken
+	}
+
+	tokens[server.ServerID] = CachedToken{
+		Source:       source,
+		AccessToken:  tokenInfo.AccessToken,
+		RefreshToken: tokenInfo.RefreshToken,
+	}
+
+	err = writeTokenCache(dataDir, tokens)
+	if err != nil {
+		log.Error().Msgf("failed to cache refreshed access token: %s", err)
+	}
+
+	return server, nil
+}
+
+// refreshArtifactoryToken refreshes an access token issued by Artifactory.
+// The refresh token in the request authenticates the refresh, so a server
+// configured with only a refresh token needs no other credentials.
+func refreshArtifactoryToken(server JFrogServers) (auth.CreateTokenResponseData, error) {
+	if server.ArtifactoryURL == "" {
+		return auth.CreateTokenResponseData{}, fmt.Errorf("server %s has no artifactory url", server.ServerID)
+	}
+
+	rtDetails := artifactoryAuth.NewArtifactoryDetails()
+	rtDetails.SetUrl(strings.TrimSuffix(server.ArtifactoryURL, "/") + "/")
+	rtDetails.SetUser(server.User)
+	if server.AccessToken != "" {
+		rtDetails.SetAccessToken(server.AccessToken)
+	}
+
+	rtManager, err := newArtifactoryServicesManager(context.TODO(), rtDetails, defaultHttpRetries)
+	if err != nil {
+		return auth.CreateTokenResponseData{}, err
+	}
+
+	params := services.NewArtifactoryRefreshTokenParams()
+	params.AccessToken = server.AccessToken
+	params.RefreshToken = server.ArtifactoryRefreshToken
+	params.Token.Username = server.User
+	return rtManager.RefreshToken(params)
+}
+
+// refreshAccessToken refreshes an access token issued by JFrog Access,
+// authenticated by the refresh token like refreshArtifactoryToken
+func refreshAccessToken(server JFrogServers) (auth.CreateTokenResponseData, error) {
+	if server.URL == "" {
+		return auth.CreateTokenResponseData{}, fmt.Errorf("server %s has no platform url to refresh its token", server.ServerID)
+	}
+
+	accessDetails := accessAuth.NewAccessDetails()
+	accessDetails.SetUrl(strings.TrimSuffix(server.URL, "/") + "/access/")
+	if server.AccessToken != "" {
+		accessDetails.SetAccessToken(server.AccessToken)
+	}
+
+	serviceConfig, err := config.NewConfigBuilder().
+		SetServiceDetails(accessDetails).
+		Build()
+
+	if err != nil {
+		return auth.CreateTokenResponseData{}, err
+	}
+
+	accessManager, err := access.New(serviceConfig)
+	if err != nil {
+		return auth.CreateTokenResponseData{}, err
+	}
+
+	return accessManager.RefreshAccessToken(auth.CommonTokenParams{
+		AccessToken:  server.AccessToken,
+		RefreshToken: server.RefreshToken,
+	})
+}
@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockTokenCacheExcludesOtherProcesses(t *testing.T) {
+	dataDir := t.TempDir()
+	unlock, err := lockTokenCache(dataDir)
+	if err != nil {
+		t.Fatalf("could not lock token cache: %s", err)
+	}
+
+	// every lock opens the lock file anew, so it conflicts
+	// like the lock of another process would
+	locked := make(chan struct{})
+	go func() {
+		unlockOther, err := lockTokenCache(dataDir)
+		if err != nil {
+			t.Errorf("could not lock token cache: %s", err)
+		} else {
+			unlockOther()
+		}
+
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("token cache was locked twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("token cache stayed locked after it was unlocked")
+	}
+}
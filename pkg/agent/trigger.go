@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// triggerJobs are the jobs that can be requested from the trigger webhook
+var triggerJobs = map[string]Job{
+	"run":   JobSync | JobApply,
+	"sync":  JobSync,
+	"apply": JobApply,
+	"check": JobCheck,
+}
+
+// triggerHandler queues a run of the runner for POST /trigger?job=<job>,
+// the job defaults to run, which syncs and applies
+func triggerHandler(agentConfig AgentConfig, runner *Runner) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if agentConfig.TriggerToken != "" {
+			expected := "Bearer " + agentConfig.TriggerToken
+			if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(expected)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		jobName := req.URL.Query().Get("job")
+		if jobName == "" {
+			jobName = "run"
+		}
+
+		jobs, ok := triggerJobs[jobName]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown job %q, expected run, sync, apply or check", jobName), http.StatusBadRequest)
+			return
+		}
+
+		log.Info().Str("job", jobName).Str("remote", req.RemoteAddr).Msg("run triggered by webhook")
+		go runner.Trigger(agentConfig, jobs, TriggerWebhook)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"job": jobName})
+	}
+}
+
+// serveTriggers listens for trigger webhook requests on the trigger listen address
+func serveTriggers(agentConfig AgentConfig, runner *Runner) error {
+	listener, err := net.Listen("tcp", agentConfig.TriggerListenAddress)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %s", agentConfig.TriggerListenAddress, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/trigger", triggerHandler(agentConfig, runner))
+
+	log.Info().Msgf("listening for triggers on %s", listener.Addr())
+	go func() {
+		err := http.Serve(listener, mux)
+		log.Error().Msgf("trigger webhook stopped: %s", err)
+	}()
+
+	return nil
+}
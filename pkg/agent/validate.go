@@ -0,0 +1,272 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ConfigError is an unknown or invalid config key.
+// Source is the layer the value came from, with the line for config files.
+type ConfigError struct {
+	Key     string
+	Source  string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	if e.Source == "" || e.Source == SourceDefault {
+		return fmt.Sprintf("%s: %s", e.Key, e.Message)
+	}
+
+	return fmt.Sprintf("%s: %s: %s", e.Source, e.Key, e.Message)
+}
+
+// ConfigErrors are all the errors found in a config
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, configError := range e {
+		messages = append(messages, configError.Error())
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// validateDuration checks that value is a positive duration
+func validateDuration(value string) string {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Sprintf("invalid duration %q, expected a value like 30s, 5m or 1h", value)
+	}
+
+	if duration <= 0 {
+		return fmt.Sprintf("duration %q must be positive", value)
+	}
+
+	return ""
+}
+
+// validateJFrogCLIConfig checks that the JFrog CLI config at path can be read
+func validateJFrogCLIConfig(path string) string {
+	if path == "" {
+		return "must be set when no artifactory url or credentials file is configured"
+	}
+
+	file, err := os.Open(os.ExpandEnv(path))
+	if err != nil {
+		return fmt.Sprintf("could not read the JFrog CLI config, set artifactory_url or artifactory_credentials_file to use doan's own credentials: %s", err)
+	}
+
+	file.Close()
+	return ""
+}
+
+// isHostIdentity checks if identity is one of the HostIdentities
+func isHostIdentity(identity string) bool {
+	for _, hostIdentity := range HostIdentities {
+		if identity == hostIdentity {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isNotifyEvent checks if event is one of the NotifyEvents
+func isNotifyEvent(event string) bool {
+	for _, notifyEvent := range NotifyEvents {
+		if event == notifyEvent {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deprecatedConfigKeys are still accepted but no longer used
+var deprecatedConfigKeys = []string{"ansible_tarball_name", "ansible_namespace"}
+
+// isLoopbackHost checks if host only accepts connections from this host,
+// an empty host listens on all interfaces
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Validate checks the values of the config and returns ConfigErrors
+// naming each invalid key and where its value came from
+func (c *AgentConfig) Validate(sources ConfigSources) error {
+	var configErrors ConfigErrors
+	invalid := func(key, message string) {
+		if message == "" {
+			return
+		}
+
+		configErrors = append(configErrors, ConfigError{
+			Key:     key,
+			Source:  sources[key],
+			Message: message,
+		})
+	}
+
+	required := map[string]string{
+		"ansible_repo_path": c.AnsibleRepoPath,
+	}
+
+	for _, key := range ConfigKeys() {
+		value, ok := required[key]
+		if ok && strings.TrimSpace(value) == "" {
+			invalid(key, "must not be empty")
+		}
+	}
+
+	for _, key := range deprecatedConfigKeys {
+		if sources[key] != "" && sources[key] != SourceDefault {
+			log.Warn().Msgf("%s: %s is deprecated and ignored, tarballs are cached by their digest", sources[key], key)
+		}
+	}
+
+	if !filepath.IsAbs(c.DataDir) {
+		invalid("data_dir", fmt.Sprintf("must be an absolute path, got %q", c.DataDir))
+	}
+
+	if c.ArtifactoryURL != "" {
+		u, err := url.Parse(c.ArtifactoryURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("artifactory_url", fmt.Sprintf("invalid url %q, expected an http or https url", c.ArtifactoryURL))
+		}
+	}
+
+	// the JFrog CLI config is only read when no native credentials are configured
+	if c.ArtifactoryURL == "" && c.ArtifactoryCredentialsFile == "" {
+		invalid("jfrog_cli_config_path", validateJFrogCLIConfig(c.JFrogCLIConfigPath))
+	}
+
+	if c.MaxStagingRepos < 1 {
+		invalid("max_staging_repos", fmt.Sprintf("must be at least 1, got %d", c.MaxStagingRepos))
+	}
+
+	if c.RetryAttempts < 1 {
+		invalid("retry_attempts", fmt.Sprintf("must be at least 1, got %d", c.RetryAttempts))
+	}
+
+	invalid("retry_base_delay", validateDuration(c.RetryBaseDelay))
+	invalid("retry_max_delay", validateDuration(c.RetryMaxDelay))
+	invalid("remote_timeout", validateDuration(c.RemoteTimeout))
+	invalid("download_timeout", validateDuration(c.DownloadTimeout))
+	invalid("galaxy_timeout", validateDuration(c.GalaxyTimeout))
+
+	if !isHostIdentity(c.RolloutIdentity) {
+		invalid("rollout_identity", fmt.Sprintf("unknown identity %q, expected one of %s", c.RolloutIdentity, strings.Join(HostIdentities, ", ")))
+	}
+
+	if c.CircuitBreakerThreshold < 0 {
+		invalid("circuit_breaker_threshold", fmt.Sprintf("must not be negative, got %d", c.CircuitBreakerThreshold))
+	}
+
+	invalid("circuit_breaker_cooldown", validateDuration(c.CircuitBreakerCooldown))
+	invalid("daemon_interval", validateDuration(c.DaemonInterval))
+	invalid("sync_interval", validateDuration(c.SyncInterval))
+
+	_, err := time.LoadLocation(c.DaemonTimezone)
+	if err != nil {
+		invalid("daemon_timezone", fmt.Sprintf("unknown timezone %q, expected a name like UTC or Europe/Berlin", c.DaemonTimezone))
+	}
+
+	if c.DaemonSchedule != "" {
+		invalid("daemon_schedule", validateSchedule(c.DaemonSchedule, c.DaemonTimezone))
+	}
+
+	optionalDurations := map[string]string{
+		"daemon_splay":           c.DaemonSplay,
+		"daemon_jitter":          c.DaemonJitter,
+		"daemon_start_delay":     c.DaemonStartDelay,
+		"lock_timeout":           c.LockTimeout,
+		"run_timeout":            c.RunTimeout,
+		"run_inactivity_timeout": c.RunInactivityTimeout,
+	}
+
+	for _, key := range ConfigKeys() {
+		value, ok := optionalDurations[key]
+		if ok && value != "" {
+			invalid(key, validateDuration(value))
+		}
+	}
+
+	invalid("daemon_splay", validateDelay(*c))
+
+	if c.LeaseSlots < 0 {
+		invalid("lease_slots", fmt.Sprintf("must not be negative, got %d", c.LeaseSlots))
+	}
+
+	if c.LeaseSlots > 0 && c.LeaseArtifactPath == "" {
+		invalid("lease_artifact_path", "must be set when lease_slots is set")
+	}
+
+	invalid("lease_ttl", validateDuration(c.LeaseTTL))
+
+	if c.TriggerListenAddress != "" {
+		host, _, err := net.SplitHostPort(c.TriggerListenAddress)
+		if err != nil {
+			invalid("trigger_listen_address", fmt.Sprintf("invalid address %q, expected host:port", c.TriggerListenAddress))
+		} else if !isLoopbackHost(host) && c.TriggerToken == "" {
+			invalid("trigger_token", fmt.Sprintf("must be set when trigger_listen_address %q is not a loopback address", c.TriggerListenAddress))
+		}
+	}
+
+	if c.DriftInterval != "" {
+		invalid("drift_interval", validateDuration(c.DriftInterval))
+	}
+
+	invalid("hook_timeout", validateDuration(c.HookTimeout))
+
+	_, err = ParseMaintenanceWindows(c.MaintenanceWindows)
+	if err != nil {
+		invalid("maintenance_windows", err.Error())
+	}
+
+	_, err = time.LoadLocation(c.MaintenanceTimezone)
+	if err != nil {
+		invalid("maintenance_timezone", fmt.Sprintf("unknown timezone %q, expected a name like UTC or Europe/Berlin", c.MaintenanceTimezone))
+	}
+
+	if c.NotifyWebhookURL != "" {
+		u, err := url.Parse(c.NotifyWebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("notify_webhook_url", fmt.Sprintf("invalid url %q, expected an http or https url", c.NotifyWebhookURL))
+		}
+	}
+
+	if strings.TrimSpace(c.NotifyEvents) != "" {
+		for _, event := range strings.Split(c.NotifyEvents, ",") {
+			if !isNotifyEvent(strings.TrimSpace(event)) {
+				invalid("notify_events", fmt.Sprintf("unknown event %q, expected one of %s", strings.TrimSpace(event), strings.Join(NotifyEvents, ", ")))
+			}
+		}
+	}
+
+	for _, header := range strings.Split(c.NotifyWebhookHeaders, ",") {
+		if strings.TrimSpace(header) != "" && !strings.Contains(header, ":") {
+			invalid("notify_webhook_headers", "expected comma separated \"Name: value\" headers")
+			break
+		}
+	}
+
+	if len(configErrors) > 0 {
+		return configErrors
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// WindowTagPrefix is the prefix of the droplet tag naming
+	// the maintenance window of a host, e.g. doan-window-weekend
+	WindowTagPrefix = "doan-window-"
+)
+
+// ErrApplyDeferred is returned when an apply is deferred
+// because it is outside the maintenance windows of the host
+var ErrApplyDeferred = errors.New("apply deferred until the next maintenance window")
+
+// NamedWindows are the maintenance windows that can be
+// selected by name in the config and by droplet tags
+var NamedWindows = map[string]string{
+	"weekend":    "Sat-Sun 00:00-24:00",
+	"weeknights": "Mon-Fri 22:00-06:00",
+	"nightly":    "* 00:00-06:00",
+	"always":     "* 00:00-24:00",
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// MaintenanceWindow is a recurring period in which applies are allowed
+type MaintenanceWindow interface {
+	Contains(t time.Time) bool
+}
+
+// spanWindow is a time span on a set of weekdays,
+// a span ending before it starts ends on the next day
+type spanWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// Contains checks if t is within the span
+func (w spanWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+	}
+
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.days[t.Weekday()] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// cronWindow is a window starting on a cron schedule and lasting duration
+type cronWindow struct {
+	schedule cron.Schedule
+	duration time.Duration
+}
+
+// Contains checks if the schedule started a window within duration before t
+func (w cronWindow) Contains(t time.Time) bool {
+	return !w.schedule.Next(t.Add(-w.duration)).After(t)
+}
+
+// parseWeekdays parses comma separated weekdays and ranges like Mon-Fri,Sun or *
+func parseWeekdays(value string) ([7]bool, error) {
+	var days [7]bool
+	if value == "*" {
+		for i := range days {
+			days[i] = true
+		}
+
+		return days, nil
+	}
+
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+
+		from, ok := weekdays[first]
+		if !ok {
+			return days, fmt.Errorf("unknown weekday %q", first)
+		}
+
+		to, ok := weekdays[last]
+		if !ok {
+			return days, fmt.Errorf("unknown weekday %q", last)
+		}
+
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseTimeOfDay parses a time like 22:00 into minutes after midnight
+func parseTimeOfDay(value string) (int, error) {
+	hours, minutes, ok := strings.Cut(value, ":")
+	h, hErr := strconv.Atoi(hours)
+	m, mErr := strconv.Atoi(minutes)
+	if !ok || hErr != nil || mErr != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q, expected a time like 22:00", value)
+	}
+
+	return h*60 + m, nil
+}
+
+// ParseMaintenanceWindow parses a window name, a weekday and time span
+// like "Mon-Fri 22:00-06:00" or a cron schedule and duration like "0 22 * * 1-5 for 8h"
+func ParseMaintenanceWindow(value string) (MaintenanceWindow, error) {
+	value = strings.TrimSpace(value)
+	if named, ok := NamedWindows[value]; ok {
+		value = named
+	}
+
+	if schedule, duration, ok := strings.Cut(value, " for "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(duration))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid window duration %q", duration)
+		}
+
+		s, err := cron.ParseStandard(strings.TrimSpace(schedule))
+		if err != nil {
+			return nil, fmt.Errorf("invalid window schedule %q: %s", schedule, err)
+		}
+
+		return cronWindow{schedule: s, duration: d}, nil
+	}
+
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid window %q, expected a name, a span like \"Mon-Fri 22:00-06:00\" or a schedule like \"0 22 * * 1-5 for 8h\"", value)
+	}
+
+	days, err := parseWeekdays(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	startTime, endTime, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid time span %q, expected a span like 22:00-06:00", fields[1])
+	}
+
+	start, err := parseTimeOfDay(startTime)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := parseTimeOfDay(endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return spanWindow{days: days, start: start, end: end}, nil
+}
+
+// ParseMaintenanceWindows parses semicolon separated maintenance windows
+func ParseMaintenanceWindows(value string) ([]MaintenanceWindow, error) {
+	windows := []MaintenanceWindow{}
+	for _, part := range strings.Split(value, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+
+		window, err := ParseMaintenanceWindow(part)
+		if err != nil {
+			return nil, err
+		}
+
+		windows = append(windows, window)
+	}
+
+	return windows, nil
+}
+
+// hostMaintenanceWindows returns the maintenance windows of the host.
+// A doan-window-<name> droplet tag takes precedence over the config,
+// so the apply is deferred with ErrApplyDeferred when the tags cannot be read.
+func hostMaintenanceWindows(agentConfig AgentConfig) ([]MaintenanceWindow, error) {
+	tags, err := getDropletTags(agentConfig)
+	if err != nil {
+		log.Warn().Msgf("could not read the maintenance window tags of the droplet: %s", err)
+		return nil, ErrApplyDeferred
+	}
+
+	for _, tag := range tags {
+		name := strings.TrimPrefix(tag, WindowTagPrefix)
+		if name == tag {
+			continue
+		}
+
+		window, ok := NamedWindows[name]
+		if !ok {
+			return nil, fmt.Errorf("droplet tag %s names an unknown maintenance window", tag)
+		}
+
+		return ParseMaintenanceWindows(window)
+	}
+
+	return ParseMaintenanceWindows(agentConfig.MaintenanceWindows)
+}
+
+// InMaintenanceWindow checks if applies are allowed at t.
+// Hosts without maintenance windows can apply at any time,
+// ErrApplyDeferred is returned when the windows are unknown.
+func InMaintenanceWindow(agentConfig AgentConfig, t time.Time) (bool, error) {
+	windows, err := hostMaintenanceWindows(agentConfig)
+	if err != nil {
+		return false, err
+	}
+
+	return inMaintenanceWindows(windows, agentConfig.MaintenanceTimezone, t)
+}
+
+// inMaintenanceWindows checks if t is within one of the windows
+// in timezone, there are no restrictions without windows
+func inMaintenanceWindows(windows []MaintenanceWindow, timezone string, t time.Time) (bool, error) {
+	if len(windows) == 0 {
+		return true, nil
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return false, fmt.Errorf("could not load timezone %s: %s", timezone, err)
+	}
+
+	for _, window := range windows {
+		if window.Contains(t.In(location)) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
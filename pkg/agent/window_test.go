@@ -0,0 +1,227 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// at returns a time in UTC, 2024-01-06 is a Saturday
+func at(value string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", value)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+func TestMaintenanceWindowContains(t *testing.T) {
+	tests := []struct {
+		window string
+		time   string
+		want   bool
+	}{
+		{"weekend", "2024-01-06 12:00", true},
+		{"weekend", "2024-01-07 23:59", true},
+		{"weekend", "2024-01-05 23:59", false},
+		{"weekend", "2024-01-08 00:00", false},
+
+		// overnight spans end on the next day
+		{"weeknights", "2024-01-08 22:00", true},
+		{"weeknights", "2024-01-08 21:59", false},
+		{"weeknights", "2024-01-09 05:59", true},
+		{"weeknights", "2024-01-09 06:00", false},
+		{"weeknights", "2024-01-06 03:00", true},
+		{"weeknights", "2024-01-07 23:00", false},
+		{"weeknights", "2024-01-08 03:00", false},
+
+		// weekday ranges wrap around the week
+		{"Fri-Mon 10:00-12:00", "2024-01-07 11:00", true},
+		{"Fri-Mon 10:00-12:00", "2024-01-10 11:00", false},
+		{"Tue,Thu 09:30-10:00", "2024-01-11 09:45", true},
+		{"Tue,Thu 09:30-10:00", "2024-01-11 10:00", false},
+		{"always", "2024-01-10 15:00", true},
+
+		// cron windows last their duration from every start
+		{"0 22 * * 1-5 for 8h", "2024-01-08 22:00", true},
+		{"0 22 * * 1-5 for 8h", "2024-01-09 05:59", true},
+		{"0 22 * * 1-5 for 8h", "2024-01-09 06:00", false},
+		{"0 22 * * 1-5 for 8h", "2024-01-06 05:00", true},
+		{"0 22 * * 1-5 for 8h", "2024-01-07 05:00", false},
+		{"30 1 * * * for 30m", "2024-01-10 01:29", false},
+		{"30 1 * * * for 30m", "2024-01-10 01:30", true},
+		{"30 1 * * * for 30m", "2024-01-10 01:59", true},
+		{"30 1 * * * for 30m", "2024-01-10 02:00", false},
+	}
+
+	for _, test := range tests {
+		window, err := ParseMaintenanceWindow(test.window)
+		if err != nil {
+			t.Errorf("could not parse %q: %s", test.window, err)
+			continue
+		}
+
+		got := window.Contains(at(test.time))
+		if got != test.want {
+			t.Errorf("%q contains %s: got %t, expected %t", test.window, test.time, got, test.want)
+		}
+	}
+}
+
+func TestParseMaintenanceWindowErrors(t *testing.T) {
+	invalid := []string{
+		"Mon-Fri",
+		"Mon 10:00",
+		"Funday 10:00-12:00",
+		"Mon-Fri 25:00-06:00",
+		"Mon-Fri 22:60-06:00",
+		"0 22 * * 1-5 for -1h",
+		"0 22 * * 1-5 for ever",
+		"0 22 * * for 8h",
+	}
+
+	for _, value := range invalid {
+		_, err := ParseMaintenanceWindow(value)
+		if err == nil {
+			t.Errorf("parsed invalid window %q", value)
+		}
+	}
+}
+
+func TestParseMaintenanceWindows(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 0},
+		{"weekend", 1},
+		{"weekend; nightly", 2},
+		{"weekend;; 0 22 * * 1-5 for 8h;", 2},
+	}
+
+	for _, test := range tests {
+		windows, err := ParseMaintenanceWindows(test.value)
+		if err != nil {
+			t.Errorf("could not parse %q: %s", test.value, err)
+			continue
+		}
+
+		if len(windows) != test.want {
+			t.Errorf("%q: got %d windows, expected %d", test.value, len(windows), test.want)
+		}
+	}
+}
+
+func TestInMaintenanceWindows(t *testing.T) {
+	tests := []struct {
+		windows  string
+		timezone string
+		time     string
+		want     bool
+	}{
+		{"", "UTC", "2024-01-10 15:00", true},
+		{"nightly", "UTC", "2024-01-10 03:00", true},
+		{"nightly", "UTC", "2024-01-10 15:00", false},
+
+		// 04:00 UTC is 23:00 the day before in New York
+		{"nightly", "America/New_York", "2024-01-08 04:00", false},
+		{"nightly", "America/New_York", "2024-01-08 06:00", true},
+
+		// 21:30 UTC is 22:30 in Berlin in winter and 23:30 in summer
+		{"0 22 * * * for 1h", "Europe/Berlin", "2024-01-08 21:30", true},
+		{"0 22 * * * for 1h", "Europe/Berlin", "2024-07-08 21:30", false},
+		{"0 22 * * * for 1h", "Europe/Berlin", "2024-07-08 20:30", true},
+
+		// Saturday 01:00 UTC is still Friday in Los Angeles
+		{"weekend", "America/Los_Angeles", "2024-01-06 01:00", false},
+		{"weekend; nightly", "America/Los_Angeles", "2024-01-06 09:00", true},
+	}
+
+	for _, test := range tests {
+		windows, err := ParseMaintenanceWindows(test.windows)
+		if err != nil {
+			t.Errorf("could not parse %q: %s", test.windows, err)
+			continue
+		}
+
+		got, err := inMaintenanceWindows(windows, test.timezone, at(test.time))
+		if err != nil {
+			t.Errorf("%q in %s: %s", test.windows, test.timezone, err)
+			continue
+		}
+
+		if got != test.want {
+			t.Errorf("%q in %s at %s UTC: got %t, expected %t", test.windows, test.timezone, test.time, got, test.want)
+		}
+	}
+
+	windows, _ := ParseMaintenanceWindows("nightly")
+	_, err := inMaintenanceWindows(windows, "Mars/Olympus_Mons", at("2024-01-10 03:00"))
+	if err == nil {
+		t.Error("checked windows in an unknown timezone")
+	}
+}
+
+// fakeMetadataAPI serves the droplet tags, or status when it is not 200,
+// and returns the number of requests it served
+func fakeMetadataAPI(t *testing.T, status int, tags string) *int {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		fmt.Fprint(w, tags)
+	}))
+	t.Cleanup(server.Close)
+
+	previousURL := dropletMetadataURL
+	dropletMetadataURL = server.URL
+	t.Cleanup(func() { dropletMetadataURL = previousURL })
+
+	return &requests
+}
+
+func TestHostMaintenanceWindows(t *testing.T) {
+	agentConfig := AgentConfig{MaintenanceWindows: "nightly; weekend"}
+
+	fakeMetadataAPI(t, http.StatusOK, "ansible-web\ndoan-window-weeknights")
+	windows, err := hostMaintenanceWindows(agentConfig)
+	if err != nil {
+		t.Fatalf("could not get the maintenance windows: %s", err)
+	}
+
+	if len(windows) != 1 {
+		t.Errorf("got %d windows, expected the 1 window of the droplet tag", len(windows))
+	}
+
+	fakeMetadataAPI(t, http.StatusOK, "ansible-web")
+	windows, err = hostMaintenanceWindows(agentConfig)
+	if err != nil {
+		t.Fatalf("could not get the maintenance windows: %s", err)
+	}
+
+	if len(windows) != 2 {
+		t.Errorf("got %d windows, expected the 2 configured windows", len(windows))
+	}
+}
+
+func TestHostMaintenanceWindowsWithMetadataError(t *testing.T) {
+	agentConfig := AgentConfig{RetryAttempts: 3}
+
+	requests := fakeMetadataAPI(t, http.StatusServiceUnavailable, "")
+	_, err := hostMaintenanceWindows(agentConfig)
+	if !errors.Is(err, ErrApplyDeferred) {
+		t.Errorf("got %v, expected the apply to be deferred", err)
+	}
+
+	if *requests != 3 {
+		t.Errorf("got %d requests, expected the tags to be read 3 times", *requests)
+	}
+}